@@ -0,0 +1,194 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"math/rand"
+	"sync"
+)
+
+// An AdaptiveSampler controls adaptive supersampling. Every pixel starts out
+// with MinSamples jittered samples. After each pass, a pixel is refined with
+// another MinSamples samples if its own samples disagree (the relative
+// standard error of their luminance is above Threshold) or if it differs
+// sharply from one of its neighbors (the relative luminance contrast is above
+// Threshold). Refinement stops once no pixel needs more samples or every
+// pixel needing them has MaxSamples.
+type AdaptiveSampler struct {
+	MinSamples int
+	MaxSamples int
+	Threshold  float64
+}
+
+// pixelStats accumulates the samples taken for a single pixel.
+type pixelStats struct {
+	lum   float64 // sum of sample luminances
+	lumSq float64 // sum of squared sample luminances
+	n     int
+}
+
+func (p *pixelStats) add(c Color) {
+	l := c.Luminance()
+	p.lum += l
+	p.lumSq += l * l
+	p.n++
+}
+
+func (p *pixelStats) mean() float64 {
+	return p.lum / float64(p.n)
+}
+
+// stdErr is the standard error of the mean luminance of p's samples.
+func (p *pixelStats) stdErr() float64 {
+	if p.n < 2 {
+		return 0
+	}
+	n := float64(p.n)
+	variance := (p.lumSq - p.lum*p.lum/n) / (n - 1)
+	if variance < 0 {
+		// Rounding error.
+		return 0
+	}
+	return math.Sqrt(variance / n)
+}
+
+// Avoid blowing up relative measurements of very dark pixels.
+const adaptiveEpsilon = 1e-3
+
+// RenderAdaptive renders the scene using adaptive supersampling
+// (r.Supersampling and r.Samples are ignored). Along with the image, it
+// returns the number of samples taken for each pixel (in the same order as
+// Image.Pix).
+func (r *Rendering) RenderAdaptive(parallelism int, a *AdaptiveSampler) (*Image, []int) {
+	scanner := NewLineScanner(r.Camera, r.HPixels)
+	r.cameraDiff = scanner.differential()
+	w, h := scanner.hPixels, scanner.vPixels
+	film := NewFilm(w, h, r.Filter)
+	samples := make(chan []filmSample)
+	splatted := make(chan struct{})
+	go func() {
+		film.splat(samples)
+		close(splatted)
+	}()
+	stats := make([]pixelStats, w*h)
+	active := make([]bool, w*h)
+	for i := range active {
+		active[i] = true
+	}
+	for pass := 0; ; pass++ {
+		r.adaptivePass(parallelism, scanner, a, stats, active, pass, samples)
+		refine := false
+		for y := 0; y < h; y++ {
+			for x := 0; x < w; x++ {
+				i := y*w + x
+				active[i] = stats[i].n < a.MaxSamples && a.needsRefinement(stats, x, y, w, h)
+				refine = refine || active[i]
+			}
+		}
+		if !refine {
+			break
+		}
+	}
+
+	close(samples)
+	<-splatted
+
+	counts := make([]int, w*h)
+	for i, p := range stats {
+		counts[i] = p.n
+	}
+	return film.Image(), counts
+}
+
+// adaptivePass takes up to a.MinSamples more samples for each active pixel and
+// sends them to out.
+func (r *Rendering) adaptivePass(parallelism int, scanner *LineScanner, a *AdaptiveSampler,
+	stats []pixelStats, active []bool, pass int, out chan<- []filmSample) {
+	w := scanner.hPixels
+	lines := scanner.Scan()
+	var wg sync.WaitGroup
+	wg.Add(parallelism)
+	for i := 0; i < parallelism; i++ {
+		rng := rand.New(rand.NewSource(int64(pass*parallelism + i)))
+		go func() {
+			for y := range lines {
+				var line []filmSample
+				for x := 0; x < w; x++ {
+					p := &stats[y*w+x]
+					if !active[y*w+x] {
+						continue
+					}
+					n := a.MinSamples
+					if p.n+n > a.MaxSamples {
+						n = a.MaxSamples - p.n
+					}
+					for j := 0; j < n; j++ {
+						fx := float64(x) + rng.Float64()
+						fy := float64(y) + rng.Float64()
+						c := r.Integrator.Li(scanner.RayAt(fx, fy), rng)
+						p.add(c)
+						line = append(line, filmSample{fx, fy, c})
+					}
+				}
+				if len(line) > 0 {
+					out <- line
+				}
+			}
+			wg.Done()
+		}()
+	}
+	wg.Wait()
+}
+
+func (a *AdaptiveSampler) needsRefinement(stats []pixelStats, x, y, w, h int) bool {
+	p := &stats[y*w+x]
+	m := p.mean()
+	if p.stdErr() > a.Threshold*(m+adaptiveEpsilon) {
+		return true
+	}
+	for _, d := range [][2]int{{-1, 0}, {1, 0}, {0, -1}, {0, 1}} {
+		nx, ny := x+d[0], y+d[1]
+		if nx < 0 || nx >= w || ny < 0 || ny >= h {
+			continue
+		}
+		nm := stats[ny*w+nx].mean()
+		if math.Abs(m-nm)/(m+nm+adaptiveEpsilon) > a.Threshold {
+			return true
+		}
+	}
+	return false
+}
+
+// SampleHeatmap visualizes per-pixel sample counts (as returned by
+// RenderAdaptive) on a scale from blue (min samples) to red (max samples).
+func SampleHeatmap(counts []int, width, height, min, max int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			t := 0.0
+			if max > min {
+				t = float64(counts[y*width+x]-min) / float64(max-min)
+			}
+			img.SetRGBA(x, y, heatColor(t))
+		}
+	}
+	return img
+}
+
+// heatColor maps t in [0, 1] through blue, cyan, green, yellow, and red.
+func heatColor(t float64) color.RGBA {
+	t = clamp(t)
+	var r, g, b float64
+	switch {
+	case t < 0.25:
+		g, b = t/0.25, 1
+	case t < 0.5:
+		g, b = 1, 1-(t-0.25)/0.25
+	case t < 0.75:
+		r, g = (t-0.5)/0.25, 1
+	default:
+		r, g = 1, 1-(t-0.75)/0.25
+	}
+	return color.RGBA{uint8(r * 0xFF), uint8(g * 0xFF), uint8(b * 0xFF), 0xFF}
+}
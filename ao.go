@@ -0,0 +1,47 @@
+package main
+
+import (
+	"math/rand"
+)
+
+// AOSettings configures ambient occlusion. At each primary hit, Samples rays
+// are sent out over the hemisphere around the normal; those that hit
+// something within Distance count as occluded.
+type AOSettings struct {
+	Samples  int
+	Distance float64
+}
+
+// defaultAO is used to render an AO buffer for scenes that don't specify AO
+// settings.
+var defaultAO = &AOSettings{Samples: 16, Distance: 1}
+
+// unoccluded returns the fraction of the (cosine-weighted) hemisphere around
+// the unit normal n at p that is not blocked within ao.Distance.
+func (s *Scene) unoccluded(p, n Vec3, ao *AOSettings, rng *rand.Rand) float64 {
+	open := 0
+	for i := 0; i < ao.Samples; i++ {
+		dir := cosineHemisphere(rng.Float64(), rng.Float64()).FromLocal(n)
+		if !s.occluded(p, dir, ao.Distance) {
+			open++
+		}
+	}
+	return float64(open) / float64(ao.Samples)
+}
+
+// An AOIntegrator renders the raw ambient occlusion buffer: each ray's
+// value is the unoccluded fraction at its first hit, as a shade of gray.
+// Rays that hit nothing are white.
+type AOIntegrator struct {
+	*Scene
+	AO *AOSettings
+}
+
+func (a AOIntegrator) Li(r Ray, rng *rand.Rand) Color {
+	h, ok := a.intersect(r)
+	if !ok {
+		return Color{1, 1, 1}
+	}
+	f := a.unoccluded(h.P, faceForward(h.Shading, r.D), a.AO, rng)
+	return Color{f, f, f}
+}
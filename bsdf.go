@@ -0,0 +1,81 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+)
+
+// A phongBSDF is the energy-normalized (modified) Phong reflection model: a
+// Lambertian lobe plus a glossy lobe around the mirror direction. It is what
+// the path tracer uses to interpret a Material.
+//
+// All directions point away from the surface, and n is the unit shading
+// normal on the same side as wo.
+type phongBSDF struct {
+	diffuse  Color   // Kd * Color
+	specular Color   // Ks * Specular
+	alpha    float64 // Phong exponent
+	// pDiffuse is the probability of sampling the diffuse lobe.
+	pDiffuse float64
+}
+
+// newPhongBSDF returns the BSDF for mat at the point tp.
+func newPhongBSDF(mat *Material, tp TexPoint) *phongBSDF {
+	b := &phongBSDF{
+		diffuse:  mat.ColorAt(tp).MulS(mat.KdAt(tp)),
+		specular: mat.SpecularAt(tp).MulS(mat.Ks),
+		alpha:    mat.Alpha,
+	}
+	ld, ls := b.diffuse.Luminance(), b.specular.Luminance()
+	if ld+ls > 0 {
+		b.pDiffuse = ld / (ld + ls)
+	}
+	return b
+}
+
+// F evaluates the BSDF for the pair of directions.
+func (b *phongBSDF) F(wo, wi, n Vec3) Color {
+	if wi.Dot(n) <= 0 {
+		return Black
+	}
+	f := b.diffuse.MulS(1 / math.Pi)
+	if cos := wi.Dot(wo.Mul(-1).Reflect(n)); cos > 0 {
+		f = f.Add(b.specular.MulS((b.alpha + 2) / (2 * math.Pi) * math.Pow(cos, b.alpha)))
+	}
+	return f
+}
+
+// Pdf is the density with which Sample chooses wi.
+func (b *phongBSDF) Pdf(wo, wi, n Vec3) float64 {
+	cos := wi.Dot(n)
+	if cos <= 0 {
+		return 0
+	}
+	pdf := b.pDiffuse * cos / math.Pi
+	if cosR := wi.Dot(wo.Mul(-1).Reflect(n)); cosR > 0 {
+		pdf += (1 - b.pDiffuse) * (b.alpha + 1) / (2 * math.Pi) * math.Pow(cosR, b.alpha)
+	}
+	return pdf
+}
+
+// Sample chooses an incident direction wi given the outgoing direction wo. It
+// returns wi, F(wo, wi, n), and Pdf(wo, wi, n). The pdf is 0 if no valid
+// direction was found.
+func (b *phongBSDF) Sample(wo, n Vec3, rng *rand.Rand) (Vec3, Color, float64) {
+	var wi Vec3
+	if rng.Float64() < b.pDiffuse {
+		wi = cosineHemisphere(rng.Float64(), rng.Float64()).FromLocal(n)
+	} else {
+		// Sample the lobe cos^alpha around the mirror direction.
+		cos := math.Pow(rng.Float64(), 1/(b.alpha+1))
+		sin := math.Sqrt(math.Max(0, 1-cos*cos))
+		phi := 2 * math.Pi * rng.Float64()
+		local := Vec3{sin * math.Cos(phi), sin * math.Sin(phi), cos}
+		wi = local.FromLocal(wo.Mul(-1).Reflect(n))
+	}
+	pdf := b.Pdf(wo, wi, n)
+	if pdf == 0 {
+		return wi, Black, 0
+	}
+	return wi, b.F(wo, wi, n), pdf
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"math"
+	"sort"
+)
+
+// An AABB is an axis-aligned bounding box. Unbounded objects (like planes)
+// have infinite boxes.
+type AABB struct {
+	Min, Max Vec3
+}
+
+// emptyAABB contains nothing; it is the identity for Union.
+var emptyAABB = AABB{
+	Min: Vec3{math.Inf(1), math.Inf(1), math.Inf(1)},
+	Max: Vec3{math.Inf(-1), math.Inf(-1), math.Inf(-1)},
+}
+
+// infiniteAABB contains everything.
+var infiniteAABB = AABB{
+	Min: Vec3{math.Inf(-1), math.Inf(-1), math.Inf(-1)},
+	Max: Vec3{math.Inf(1), math.Inf(1), math.Inf(1)},
+}
+
+func (b AABB) Union(c AABB) AABB {
+	return AABB{
+		Min: Vec3{math.Min(b.Min.X, c.Min.X), math.Min(b.Min.Y, c.Min.Y), math.Min(b.Min.Z, c.Min.Z)},
+		Max: Vec3{math.Max(b.Max.X, c.Max.X), math.Max(b.Max.Y, c.Max.Y), math.Max(b.Max.Z, c.Max.Z)},
+	}
+}
+
+func (b AABB) bounded() bool {
+	for _, v := range [6]float64{b.Min.X, b.Min.Y, b.Min.Z, b.Max.X, b.Max.Y, b.Max.Z} {
+		if math.IsInf(v, 0) {
+			return false
+		}
+	}
+	return true
+}
+
+func (b AABB) centroid() Vec3 {
+	return b.Min.Add(b.Max).Mul(0.5)
+}
+
+// transform returns a box containing b transformed by m.
+func (b AABB) transform(m Matrix4) AABB {
+	if !b.bounded() {
+		return infiniteAABB
+	}
+	t := emptyAABB
+	for i := 0; i < 8; i++ {
+		c := b.Min
+		if i&1 != 0 {
+			c.X = b.Max.X
+		}
+		if i&2 != 0 {
+			c.Y = b.Max.Y
+		}
+		if i&4 != 0 {
+			c.Z = b.Max.Z
+		}
+		p := m.MulPoint(c)
+		t = t.Union(AABB{p, p})
+	}
+	return t
+}
+
+// hit reports whether r passes through b at a distance less than maxD.
+func (b AABB) hit(r Ray, maxD float64) bool {
+	_, _, ok := b.clip(r, 0, maxD)
+	return ok
+}
+
+// clip returns the part [tNear, tFar] of the range [tMin, tMax] of r's
+// parameter in which r is inside b. It is the slab test (see RPrism).
+func (b AABB) clip(r Ray, tMin, tMax float64) (tNear, tFar float64, ok bool) {
+	v := [3]float64{r.V.X, r.V.Y, r.V.Z}
+	d := [3]float64{r.D.X, r.D.Y, r.D.Z}
+	lo := [3]float64{b.Min.X, b.Min.Y, b.Min.Z}
+	hi := [3]float64{b.Max.X, b.Max.Y, b.Max.Z}
+	tNear, tFar = tMin, tMax
+	for i := 0; i < 3; i++ {
+		if d[i] == 0 {
+			if v[i] < lo[i] || v[i] > hi[i] {
+				return 0, 0, false
+			}
+			continue
+		}
+		t0 := (lo[i] - v[i]) / d[i]
+		t1 := (hi[i] - v[i]) / d[i]
+		if t0 > t1 {
+			t0, t1 = t1, t0
+		}
+		tNear = math.Max(tNear, t0)
+		tFar = math.Min(tFar, t1)
+		if tNear > tFar {
+			return 0, 0, false
+		}
+	}
+	return tNear, tFar, true
+}
+
+// Objects are grouped into BVH leaves of at most this many.
+const bvhLeafSize = 4
+
+// A bvh is a bounding volume hierarchy: a binary tree of boxes that lets a
+// ray skip the objects in any box it misses. It is itself an Object.
+type bvh struct {
+	objects   []Object // bounded objects, in leaf order
+	nodes     []bvhNode
+	unbounded []Object // objects with infinite bounds, which are always tested
+	bounds    AABB
+}
+
+// A bvhNode is either a leaf containing objects[start:start+count] or (if
+// count is 0) an interior node whose children are the following node and
+// nodes[right].
+type bvhNode struct {
+	bounds       AABB
+	start, count int
+	right        int
+}
+
+type bvhItem struct {
+	obj    Object
+	bounds AABB
+}
+
+func newBVH(objects []Object) *bvh {
+	b := &bvh{bounds: emptyAABB}
+	var items []bvhItem
+	for _, o := range objects {
+		ob := o.Bounds()
+		b.bounds = b.bounds.Union(ob)
+		if ob.bounded() {
+			items = append(items, bvhItem{o, ob})
+		} else {
+			b.unbounded = append(b.unbounded, o)
+		}
+	}
+	if len(items) > 0 {
+		b.build(items)
+	}
+	return b
+}
+
+func (b *bvh) build(items []bvhItem) int {
+	i := len(b.nodes)
+	b.nodes = append(b.nodes, bvhNode{})
+	bounds, centroids := emptyAABB, emptyAABB
+	for _, it := range items {
+		bounds = bounds.Union(it.bounds)
+		c := it.bounds.centroid()
+		centroids = centroids.Union(AABB{c, c})
+	}
+	if len(items) <= bvhLeafSize {
+		b.nodes[i] = bvhNode{bounds: bounds, start: len(b.objects), count: len(items)}
+		for _, it := range items {
+			b.objects = append(b.objects, it.obj)
+		}
+		return i
+	}
+	// Split at the median along the axis in which the centroids are most
+	// spread out.
+	ext := centroids.Max.Sub(centroids.Min)
+	axis := 0
+	if ext.Y > ext.X {
+		axis = 1
+	}
+	if ext.Z > axisValue(ext, axis) {
+		axis = 2
+	}
+	sort.Slice(items, func(j, k int) bool {
+		return axisValue(items[j].bounds.centroid(), axis) < axisValue(items[k].bounds.centroid(), axis)
+	})
+	mid := len(items) / 2
+	b.build(items[:mid])
+	right := b.build(items[mid:])
+	b.nodes[i] = bvhNode{bounds: bounds, right: right}
+	return i
+}
+
+// Initialize does nothing; a bvh is built from initialized objects.
+func (b *bvh) Initialize(map[string]*Material) error { return nil }
+
+func (b *bvh) Bounds() AABB { return b.bounds }
+
+func (b *bvh) Intersect(r Ray, h *Hit) bool {
+	found := false
+	for _, o := range b.unbounded {
+		if o.Intersect(r, h) {
+			found = true
+		}
+	}
+	if len(b.nodes) == 0 {
+		return found
+	}
+	var stack [64]int
+	stack[0] = 0
+	n := 1
+	for n > 0 {
+		n--
+		i := stack[n]
+		node := &b.nodes[i]
+		if !node.bounds.hit(r, h.D) {
+			continue
+		}
+		if node.count > 0 {
+			for _, o := range b.objects[node.start : node.start+node.count] {
+				if o.Intersect(r, h) {
+					found = true
+				}
+			}
+			continue
+		}
+		stack[n] = node.right
+		stack[n+1] = i + 1
+		n += 2
+	}
+	return found
+}
+
+func (b *bvh) Occluded(r Ray, maxD float64) bool {
+	for _, o := range b.unbounded {
+		if o.Occluded(r, maxD) {
+			return true
+		}
+	}
+	if len(b.nodes) == 0 {
+		return false
+	}
+	var stack [64]int
+	stack[0] = 0
+	n := 1
+	for n > 0 {
+		n--
+		i := stack[n]
+		node := &b.nodes[i]
+		if !node.bounds.hit(r, maxD) {
+			continue
+		}
+		if node.count > 0 {
+			for _, o := range b.objects[node.start : node.start+node.count] {
+				if o.Occluded(r, maxD) {
+					return true
+				}
+			}
+			continue
+		}
+		stack[n] = node.right
+		stack[n+1] = i + 1
+		n += 2
+	}
+	return false
+}
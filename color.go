@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"math"
 	"strconv"
 	"strings"
 )
@@ -49,6 +50,17 @@ func (c1 Color) MulS(f float64) Color {
 	}
 }
 
+// Max returns the largest channel value of c.
+func (c1 Color) Max() float64 {
+	return math.Max(c1.R, math.Max(c1.G, c1.B))
+}
+
+// Luminance returns the relative luminance of c (using the Rec. 709
+// weights).
+func (c1 Color) Luminance() float64 {
+	return 0.2126*c1.R + 0.7152*c1.G + 0.0722*c1.B
+}
+
 func clamp(f float64) float64 {
 	switch {
 	case f < 0:
@@ -69,7 +81,7 @@ func (c *Color) RGBA() (r, g, b, a uint32) {
 
 func (c *Color) UnmarshalJSON(b []byte) error {
 	if len(b) < 2 {
-		return fmt.Errorf("Bad color string: %s", string(b))
+		return fmt.Errorf("bad color string: %s", string(b))
 	}
 	if b[0] == '"' {
 		b = b[1:]
@@ -105,5 +117,5 @@ func ParseHexColor(c string) (Color, error) {
 		rgba.B = float64(rgb&0xFF) / 0xFF
 		return rgba, nil
 	}
-	return rgba, fmt.Errorf("Bad color string: %s", c)
+	return rgba, fmt.Errorf("bad color string: %s", c)
 }
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+)
+
+// A Solid is a closed object with a well-defined inside, which can take part
+// in constructive solid geometry.
+type Solid interface {
+	Object
+	// Intervals appends to ivs the intervals, in increasing order, in which
+	// the line through r is inside the solid. Unlike Intersect, this
+	// includes intersections behind r.V (with negative distances).
+	Intervals(r Ray, ivs []Interval) []Interval
+}
+
+// An Interval is a stretch of a ray inside a solid, from where the ray
+// enters (In) to where it leaves (Out). Both normals point out of the solid.
+type Interval struct {
+	In, Out Hit
+}
+
+// A CSG combines solids using a set operation. For "difference", the
+// result is the first child minus all the others. Each part of the surface
+// has the material of the child it came from; children that don't name a
+// material use the CSG's.
+type CSG struct {
+	Op        string // union, intersection, or difference
+	Children  []*ObjectSpec
+	MatName   string `json:"mat"`
+	Transform *Transform
+}
+
+// An ObjectSpec is a child of a CSG. Exactly one of its fields is set.
+// Cylinders and cones must be capped.
+type ObjectSpec struct {
+	RPrism   *RPrism
+	Sphere   *Sphere
+	Cylinder *Cylinder
+	Cone     *Cone
+	Torus    *Torus
+	CSG      *CSG
+}
+
+type csgOp int
+
+const (
+	csgUnion csgOp = iota
+	csgIntersection
+	csgDifference
+)
+
+// inside reports whether a point inside a (or not) and inside b (or not) is
+// inside the result.
+func (op csgOp) inside(a, b bool) bool {
+	switch op {
+	case csgUnion:
+		return a || b
+	case csgIntersection:
+		return a && b
+	}
+	return a && !b
+}
+
+// buildCSG builds c into an object. mat is the default material from the
+// enclosing groups or CSGs.
+func buildCSG(c *CSG, mat string, materials map[string]*Material) (Object, error) {
+	if c.MatName != "" {
+		mat = c.MatName
+	}
+	node := &csgNode{}
+	switch c.Op {
+	case "union":
+		node.op = csgUnion
+	case "intersection":
+		node.op = csgIntersection
+	case "difference":
+		node.op = csgDifference
+	default:
+		return nil, fmt.Errorf("unknown CSG operation %q", c.Op)
+	}
+	if len(c.Children) == 0 {
+		return nil, errors.New("CSG has no children")
+	}
+	for i, spec := range c.Children {
+		o, err := spec.build(mat, materials)
+		if err != nil {
+			return nil, fmt.Errorf("child %d: %s", i, err)
+		}
+		node.children = append(node.children, o.(Solid))
+	}
+	if c.Transform == nil {
+		return node, nil
+	}
+	return newTransformed(node, c.Transform)
+}
+
+func (s *ObjectSpec) build(mat string, materials map[string]*Material) (Object, error) {
+	// Children are copied because the defaults filled in here depend on
+	// where the CSG appears (for instance, in several groups).
+	init := func(o Object, matName *string, t *Transform) (Object, error) {
+		if *matName == "" {
+			*matName = mat
+		}
+		return initObject(o, t, materials)
+	}
+	switch {
+	case s.RPrism != nil:
+		c := *s.RPrism
+		return init(&c, &c.MatName, c.Transform)
+	case s.Sphere != nil:
+		c := *s.Sphere
+		return init(&c, &c.MatName, c.Transform)
+	case s.Cylinder != nil:
+		if !s.Cylinder.Capped {
+			return nil, errors.New("an uncapped cylinder is not a solid")
+		}
+		c := *s.Cylinder
+		return init(&c, &c.MatName, c.Transform)
+	case s.Cone != nil:
+		if !s.Cone.Capped {
+			return nil, errors.New("an uncapped cone is not a solid")
+		}
+		c := *s.Cone
+		return init(&c, &c.MatName, c.Transform)
+	case s.Torus != nil:
+		c := *s.Torus
+		return init(&c, &c.MatName, c.Transform)
+	case s.CSG != nil:
+		return buildCSG(s.CSG, mat, materials)
+	}
+	return nil, errors.New("empty CSG child")
+}
+
+// A csgNode is a built CSG.
+type csgNode struct {
+	op       csgOp
+	children []Solid
+}
+
+// Initialize does nothing; the children are initialized when they are built.
+func (c *csgNode) Initialize(map[string]*Material) error { return nil }
+
+func (c *csgNode) Intervals(r Ray, ivs []Interval) []Interval {
+	result := c.children[0].Intervals(r, nil)
+	for _, child := range c.children[1:] {
+		result = c.op.combine(result, child.Intervals(r, nil))
+	}
+	return append(ivs, result...)
+}
+
+// combine merges the interval lists a and b by sweeping along the ray
+// through their boundaries in order, keeping track of whether the ray is
+// inside each.
+func (op csgOp) combine(a, b []Interval) []Interval {
+	var result []Interval
+	var cur Interval
+	var inA, inB, in bool
+	i, j := 0, 0
+	for i < 2*len(a) || j < 2*len(b) {
+		ta, tb := math.Inf(1), math.Inf(1)
+		if i < 2*len(a) {
+			ta = boundary(a, i).D
+		}
+		if j < 2*len(b) {
+			tb = boundary(b, j).D
+		}
+		var h Hit
+		if ta <= tb {
+			h = *boundary(a, i)
+			i++
+			inA = !inA
+		} else {
+			h = *boundary(b, j)
+			j++
+			inB = !inB
+			if op == csgDifference {
+				// The inside of b is the outside of the result.
+				h.flip()
+			}
+		}
+		now := op.inside(inA, inB)
+		switch {
+		case now && !in:
+			cur.In = h
+		case !now && in:
+			cur.Out = h
+			result = append(result, cur)
+		}
+		in = now
+	}
+	return result
+}
+
+// boundary returns the kth boundary of ivs: the In or Out of ivs[k/2].
+func boundary(ivs []Interval, k int) *Hit {
+	if k%2 == 0 {
+		return &ivs[k/2].In
+	}
+	return &ivs[k/2].Out
+}
+
+func (c *csgNode) Intersect(r Ray, h *Hit) bool {
+	for _, iv := range c.Intervals(r, nil) {
+		var b *Hit
+		switch {
+		case iv.In.D > minDistance:
+			b = &iv.In
+		case iv.Out.D > minDistance:
+			b = &iv.Out
+		default:
+			continue
+		}
+		if b.D >= h.D {
+			return false
+		}
+		*h = *b
+		return true
+	}
+	return false
+}
+
+func (c *csgNode) Occluded(r Ray, maxD float64) bool {
+	h := Hit{D: maxD}
+	return c.Intersect(r, &h)
+}
+
+func (c *csgNode) Bounds() AABB {
+	b := c.children[0].Bounds()
+	for _, child := range c.children[1:] {
+		cb := child.Bounds()
+		switch c.op {
+		case csgUnion:
+			b = b.Union(cb)
+		case csgIntersection:
+			b = AABB{
+				Min: Vec3{math.Max(b.Min.X, cb.Min.X), math.Max(b.Min.Y, cb.Min.Y), math.Max(b.Min.Z, cb.Min.Z)},
+				Max: Vec3{math.Min(b.Max.X, cb.Max.X), math.Min(b.Max.Y, cb.Max.Y), math.Min(b.Max.Z, cb.Max.Z)},
+			}
+		}
+		// A difference is no bigger than its first child.
+	}
+	return b
+}
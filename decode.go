@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+)
+
+// A decodeError is a problem with a value in a JSON document that starts
+// just before offset.
+type decodeError struct {
+	offset int64
+	err    error
+}
+
+func (e *decodeError) Error() string { return e.err.Error() }
+
+// decodeStrict decodes raw into v, which must be a pointer. Unlike
+// json.Unmarshal, it rejects fields that don't exist in v, and its errors
+// all say where in raw they happened (see jsonError).
+func decodeStrict(raw []byte, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.DisallowUnknownFields()
+	err := dec.Decode(v)
+	if err == nil {
+		if _, err := dec.Token(); err != io.EOF {
+			return &decodeError{dec.InputOffset(), errors.New("unexpected data after the top-level value")}
+		}
+		return nil
+	}
+	if _, ok := err.(*json.SyntaxError); !ok {
+		// Errors for unknown fields and from UnmarshalJSON methods don't
+		// say where they happened; find out by walking the document.
+		w := &jsonWalker{raw: raw, dec: json.NewDecoder(bytes.NewReader(raw))}
+		if werr := w.value(reflect.TypeOf(v)); werr != nil {
+			err = werr
+		}
+	}
+	return err
+}
+
+// A jsonWalker walks a JSON document alongside the Go type it will be
+// decoded into, looking for fields the type doesn't have, values of the
+// wrong type, and values its UnmarshalJSON methods reject.
+type jsonWalker struct {
+	raw []byte
+	dec *json.Decoder
+}
+
+var unmarshalerType = reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()
+
+// next returns the offset of the start of the next token.
+func (w *jsonWalker) next() int64 { return nextToken(w.raw, w.dec.InputOffset()) }
+
+// nextToken skips the whitespace and separators at off in raw and returns
+// the offset of the token that follows.
+func nextToken(raw []byte, off int64) int64 {
+	for off < int64(len(raw)) && bytes.IndexByte([]byte(" \t\r\n:,"), raw[off]) >= 0 {
+		off++
+	}
+	return off
+}
+
+func (w *jsonWalker) value(t reflect.Type) error {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	start := w.next()
+	if reflect.PtrTo(t).Implements(unmarshalerType) {
+		var m json.RawMessage
+		if err := w.dec.Decode(&m); err != nil {
+			return err
+		}
+		if err := reflect.New(t).Interface().(json.Unmarshaler).UnmarshalJSON(m); err != nil {
+			return &decodeError{start + 1, err}
+		}
+		return nil
+	}
+	switch t.Kind() {
+	case reflect.Struct, reflect.Map, reflect.Slice, reflect.Array:
+	default:
+		err := w.dec.Decode(reflect.New(t).Interface())
+		if e, ok := err.(*json.UnmarshalTypeError); ok {
+			return &decodeError{start + 1, fmt.Errorf("cannot use %s as %s", e.Value, t)}
+		}
+		return err
+	}
+	tok, err := w.dec.Token()
+	if err != nil || tok == nil {
+		return err
+	}
+	switch t.Kind() {
+	case reflect.Struct, reflect.Map:
+		if tok != json.Delim('{') {
+			return &decodeError{start + 1, errors.New("expected an object")}
+		}
+		var fields map[string]reflect.Type
+		if t.Kind() == reflect.Struct {
+			fields = make(map[string]reflect.Type)
+			jsonFields(t, fields)
+		}
+		for w.dec.More() {
+			keyStart := w.next()
+			k, err := w.dec.Token()
+			if err != nil {
+				return err
+			}
+			key, _ := k.(string)
+			var elem reflect.Type
+			if fields == nil {
+				elem = t.Elem()
+			} else if elem = fields[strings.ToLower(key)]; elem == nil {
+				return &decodeError{keyStart + 1, fmt.Errorf("unknown field %q", key)}
+			}
+			if err := w.value(elem); err != nil {
+				return err
+			}
+		}
+	default:
+		if tok != json.Delim('[') {
+			return &decodeError{start + 1, errors.New("expected an array")}
+		}
+		for w.dec.More() {
+			if err := w.value(t.Elem()); err != nil {
+				return err
+			}
+		}
+	}
+	_, err = w.dec.Token() // the closing delimiter
+	return err
+}
+
+// jsonFields adds the fields of the struct type t that encoding/json decodes
+// to fields, by lowercased name. Fields of embedded structs are included
+// unless a shallower field has the same name.
+func jsonFields(t reflect.Type, fields map[string]reflect.Type) {
+	var embedded []reflect.Type
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name := strings.Split(tag, ",")[0]
+		if f.Anonymous && name == "" {
+			ft := f.Type
+			if ft.Kind() == reflect.Ptr {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				embedded = append(embedded, ft)
+				continue
+			}
+		}
+		if f.PkgPath != "" {
+			continue // unexported
+		}
+		if name == "" {
+			name = f.Name
+		}
+		fields[strings.ToLower(name)] = f.Type
+	}
+	for _, et := range embedded {
+		sub := make(map[string]reflect.Type)
+		jsonFields(et, sub)
+		for name, ft := range sub {
+			if _, ok := fields[name]; !ok {
+				fields[name] = ft
+			}
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestDecodeStrict(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		raw  string
+		want string // the error message, or "" for none
+	}{
+		{
+			name: "valid",
+			raw:  "{\n  \"rprisms\": [{\"pos\": [0, 0, 0], \"dim\": [1, 1, 1]}]\n}",
+			want: "",
+		},
+		{
+			name: "unknown top-level field",
+			raw:  "{\n  \"camra\": {}\n}",
+			want: `JSON error at line 2, column 3: unknown field "camra"`,
+		},
+		{
+			name: "unknown nested field",
+			raw:  "{\n  \"camera\": {\n    \"loc\": {\"v\": [0, 0, 0], \"dir\": [0, 0, -1]}\n  }\n}",
+			want: `JSON error at line 3, column 29: unknown field "dir"`,
+		},
+		{
+			name: "vector with 2 elements",
+			raw:  "{\n  \"planes\": [{\"v1\": [0, 0]}]\n}",
+			want: "JSON error at line 2, column 21: vector needs 3 elements; got 2",
+		},
+		{
+			name: "vector with 4 elements",
+			raw:  "{\n  \"planes\": [{\"v1\": [0, 0, 0, 0]}]\n}",
+			want: "JSON error at line 2, column 21: vector needs 3 elements; got 4",
+		},
+		{
+			name: "object instead of array",
+			raw:  "{\n  \"planes\": {}\n}",
+			want: "JSON error at line 2, column 13: expected an array",
+		},
+		{
+			name: "trailing data",
+			raw:  "{}\n{}",
+			want: "JSON error at line 2, column 1: unexpected data after the top-level value",
+		},
+		{
+			// Primitives is embedded in Scene, so its fields are top-level.
+			name: "promoted fields of an embedded struct",
+			raw:  "{\n  \"quads\": [{\"corner\": [0, 0, 0], \"edge1\": [1, 0, 0]}]\n}",
+			want: "",
+		},
+		{
+			// Quad embeds a PlaneObject with a "-" tag, so its fields
+			// aren't part of a quad's description.
+			name: "fields of an excluded embedded struct",
+			raw:  "{\n  \"quads\": [{\"corner\": [0, 0, 0], \"v1\": [0, 0, 0]}]\n}",
+			want: `JSON error at line 2, column 35: unknown field "v1"`,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			raw := []byte(tt.raw)
+			var got string
+			if err := decodeStrict(raw, new(Scene)); err != nil {
+				got = jsonError(raw, err).Error()
+			}
+			if got != tt.want {
+				t.Errorf("got error %q; want %q", got, tt.want)
+			}
+		})
+	}
+}
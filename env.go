@@ -0,0 +1,259 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+)
+
+// An Environment describes the light arriving from beyond the scene, which is
+// what rays that miss every object see. It is also sampled as a light source.
+type Environment struct {
+	Type string // "color", "gradient", "map", or "sky"
+
+	Color Color // For "color": uniform radiance
+
+	// For "gradient": radiance straight up and straight down (blended by the
+	// direction's Y component)
+	Top, Bottom Color
+
+	// For "map": an equirectangular .hdr or .pfm image, with +Y at the top
+	// and -Z at the center
+	File string
+
+	// For "sky": the Preetham daylight model, which also adds a matching
+	// directional light for the sun. The sun's position is given either by
+	// elevation and azimuth (clockwise from north, which is -Z) or by a
+	// date (YYYY-MM-DD), local solar time (HH:MM), and latitude.
+	SunElevation Rad
+	SunAzimuth   Rad
+	Date         string
+	Time         string
+	Latitude     Rad
+	Turbidity    float64 // Haziness, from 2 (clear) to 10 (0 means 3)
+
+	Rotation  Rad     // Rotation about the Y axis (for skies, this moves the sun)
+	Intensity float64 // Scale for the radiance (0 means 1)
+}
+
+// The resolution at which analytic environments are tabulated for sampling.
+const envTableWidth, envTableHeight = 64, 32
+
+func (e *Environment) Initialize() (*envLight, error) {
+	l := &envLight{scale: e.Intensity}
+	if l.scale == 0 {
+		l.scale = 1
+	}
+	switch e.Type {
+	case "color":
+		l.radiance = func(Vec3) Color { return e.Color }
+	case "gradient":
+		l.radiance = func(d Vec3) Color {
+			t := 0.5 * (d.Y + 1)
+			return e.Bottom.MulS(1 - t).Add(e.Top.MulS(t))
+		}
+	case "sky":
+		elevation, azimuth := float64(e.SunElevation), float64(e.SunAzimuth)
+		if e.Date != "" {
+			var err error
+			elevation, azimuth, err = solarPosition(e.Date, e.Time, float64(e.Latitude))
+			if err != nil {
+				return nil, err
+			}
+		}
+		// Rotate the sun the way uv rotates maps. The sky is symmetric
+		// about the sun's azimuth, so this rotates all of it.
+		azimuth -= float64(e.Rotation)
+		turbidity := e.Turbidity
+		if turbidity == 0 {
+			turbidity = 3
+		}
+		sky := newSky(sunDirection(elevation, azimuth), turbidity)
+		l.radiance = sky.radiance
+		if c := sky.sunColor(); c != Black {
+			l.sun = &DLight{Dir: sky.sun.Mul(-1), Color: c.MulS(l.scale)}
+		}
+	case "map":
+		img, err := LoadHDRImage(e.File)
+		if err != nil {
+			return nil, err
+		}
+		l.img = img
+		l.rotation = float64(e.Rotation)
+		l.radiance = l.lookup
+	default:
+		return nil, fmt.Errorf("unknown environment type %q", e.Type)
+	}
+	l.buildDistribution()
+	return l, nil
+}
+
+// An envLight is the light from an Environment. Directions are sampled in
+// proportion to the environment's brightness.
+type envLight struct {
+	radiance func(d Vec3) Color // in world directions, before scaling
+	img      *Image             // for maps; otherwise nil
+	rotation float64            // for maps
+	scale    float64
+	sun      *DLight // for skies
+
+	// The sampling distribution is piecewise constant over the pixels of
+	// an equirectangular table (img itself, for maps).
+	width, height int
+	rows          *distribution1D   // marginal distribution of rows
+	cols          []*distribution1D // conditional distribution in each row
+}
+
+// uv maps a unit direction to equirectangular coordinates in [0, 1)².
+func (l *envLight) uv(d Vec3) (u, v float64) {
+	phi := math.Atan2(d.X, -d.Z) + l.rotation
+	u = phi / (2 * math.Pi)
+	u -= math.Floor(u)
+	v = math.Acos(math.Max(-1, math.Min(1, d.Y))) / math.Pi
+	return u, v
+}
+
+// dir is the inverse of uv.
+func (l *envLight) dir(u, v float64) Vec3 {
+	theta := v * math.Pi
+	phi := u*2*math.Pi - l.rotation
+	sin := math.Sin(theta)
+	return Vec3{sin * math.Sin(phi), math.Cos(theta), -sin * math.Cos(phi)}
+}
+
+func (l *envLight) lookup(d Vec3) Color {
+	u, v := l.uv(d)
+	x := int(u * float64(l.img.Width))
+	y := int(v * float64(l.img.Height))
+	if x >= l.img.Width {
+		x = l.img.Width - 1
+	}
+	if y >= l.img.Height {
+		y = l.img.Height - 1
+	}
+	return l.img.At(x, y)
+}
+
+func (l *envLight) buildDistribution() {
+	l.width, l.height = envTableWidth, envTableHeight
+	if l.img != nil {
+		l.width, l.height = l.img.Width, l.img.Height
+	}
+	rowWeights := make([]float64, l.height)
+	l.cols = make([]*distribution1D, l.height)
+	for y := 0; y < l.height; y++ {
+		v := (float64(y) + 0.5) / float64(l.height)
+		// Rows near the poles cover less solid angle.
+		sin := math.Sin(v * math.Pi)
+		w := make([]float64, l.width)
+		for x := range w {
+			var c Color
+			if l.img != nil {
+				c = l.img.At(x, y)
+			} else {
+				c = l.radiance(l.dir((float64(x)+0.5)/float64(l.width), v))
+			}
+			w[x] = c.Luminance() * sin
+		}
+		l.cols[y] = newDistribution1D(w)
+		rowWeights[y] = l.cols[y].total
+	}
+	l.rows = newDistribution1D(rowWeights)
+}
+
+// Le is the radiance carried by a ray that escapes the scene in the unit
+// direction d.
+func (l *envLight) Le(d Vec3) Color {
+	return l.radiance(d).MulS(l.scale)
+}
+
+func (l *envLight) SampleLi(p Vec3, rng *rand.Rand) (Vec3, float64, Color, float64) {
+	y, py := l.rows.sample(rng.Float64())
+	x, px := l.cols[y].sample(rng.Float64())
+	if py == 0 || px == 0 {
+		return Vec3{}, 0, Black, 0
+	}
+	v := (float64(y) + rng.Float64()) / float64(l.height)
+	d := l.dir((float64(x)+rng.Float64())/float64(l.width), v)
+	pdf := l.pdfUV(py*px, v)
+	if pdf == 0 {
+		return d, 0, Black, 0
+	}
+	return d, math.Inf(1), l.Le(d), pdf
+}
+
+func (l *envLight) PdfLi(p, wi Vec3) float64 {
+	u, v := l.uv(wi)
+	x := int(u * float64(l.width))
+	y := int(v * float64(l.height))
+	if x >= l.width {
+		x = l.width - 1
+	}
+	if y >= l.height {
+		y = l.height - 1
+	}
+	return l.pdfUV(l.rows.prob(y)*l.cols[y].prob(x), v)
+}
+
+// pdfUV converts the probability of a table pixel to a density over solid
+// angle for a direction at row coordinate v within it.
+func (l *envLight) pdfUV(prob, v float64) float64 {
+	sin := math.Sin(v * math.Pi)
+	if sin == 0 {
+		return 0
+	}
+	// Density over the unit square, then the Jacobian of the mapping to
+	// the sphere, 2π²sin(θ).
+	return prob * float64(l.width*l.height) / (2 * math.Pi * math.Pi * sin)
+}
+
+func (l *envLight) Delta() bool { return false }
+
+// A distribution1D is a discrete probability distribution proportional to
+// some non-negative weights.
+type distribution1D struct {
+	weights []float64
+	cdf     []float64 // cdf[i] is the probability of an index < i
+	total   float64
+}
+
+func newDistribution1D(weights []float64) *distribution1D {
+	d := &distribution1D{weights: weights, cdf: make([]float64, len(weights)+1)}
+	for i, w := range weights {
+		d.cdf[i+1] = d.cdf[i] + w
+	}
+	d.total = d.cdf[len(weights)]
+	if d.total > 0 {
+		for i := range d.cdf {
+			d.cdf[i] /= d.total
+		}
+	}
+	return d
+}
+
+// sample picks an index using the uniform sample u and returns it along with
+// its probability.
+func (d *distribution1D) sample(u float64) (int, float64) {
+	if d.total == 0 {
+		return 0, 0
+	}
+	i := sort.SearchFloat64s(d.cdf, u)
+	// cdf[i-1] < u <= cdf[i], so u falls in bucket i-1. Skip any
+	// zero-weight buckets that share the same cdf value.
+	i--
+	if i < 0 {
+		i = 0
+	}
+	for i < len(d.weights)-1 && d.weights[i] == 0 {
+		i++
+	}
+	return i, d.prob(i)
+}
+
+func (d *distribution1D) prob(i int) float64 {
+	if d.total == 0 {
+		return 0
+	}
+	return d.weights[i] / d.total
+}
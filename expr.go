@@ -0,0 +1,474 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Numeric fields in a scene file may be given as strings holding arithmetic
+// expressions, like "2*$spacing + 1". Expressions may use
+//
+//   - numbers and the constant pi
+//   - variables from the file's "vars" block, as $name
+//   - the operators + - * / % and ^ (power), and parentheses
+//   - the functions sin, cos, tan, asin, acos, atan, atan2 (all in degrees,
+//     like the angles elsewhere in scene files), sqrt, abs, floor, ceil,
+//     round, min, max, pow, exp, and log
+//
+// A variable's value may be an expression using the variables before it.
+// Variables belong to the file that defines them; included files don't see
+// them.
+
+// An edit replaces raw[start:end] with text.
+type edit struct {
+	start, end int64
+	text       string
+}
+
+// An expansion is a JSON document in which expressions have been replaced
+// by their values.
+type expansion struct {
+	raw   []byte
+	edits []edit // in order
+}
+
+// origOffset converts an offset in x.raw to the corresponding offset in the
+// original document. Offsets within a replaced value, or just past its end,
+// go to its start.
+func (x *expansion) origOffset(off int64) int64 {
+	var shift int64
+	for _, e := range x.edits {
+		start := e.start + shift
+		if off <= start {
+			break
+		}
+		if off <= start+int64(len(e.text)) {
+			return e.start + 1
+		}
+		shift += int64(len(e.text)) - (e.end - e.start)
+	}
+	return off - shift
+}
+
+// origError converts an error about x.raw into one about the original
+// document.
+func (x *expansion) origError(err error) error {
+	var offset int64
+	switch e := err.(type) {
+	case *json.SyntaxError:
+		offset = e.Offset
+	case *json.UnmarshalTypeError:
+		offset = e.Offset
+	case *decodeError:
+		offset = e.offset
+	default:
+		return err
+	}
+	return &decodeError{x.origOffset(offset), err}
+}
+
+// expandExprs evaluates the expressions in the numeric fields of raw, which
+// will be decoded into a value of type t.
+func expandExprs(raw []byte, t reflect.Type) (*expansion, error) {
+	w := &exprWalker{raw: raw, vars: make(map[string]float64)}
+	// Read the variables first, so that they can be used anywhere.
+	if off, ok := jsonOffset(raw, jsonPath{"vars"}); ok {
+		if err := w.readVars(off); err != nil {
+			return nil, err
+		}
+	}
+	w.dec = json.NewDecoder(bytes.NewReader(raw))
+	if err := w.value(t); err != nil {
+		return nil, err
+	}
+	x := &expansion{raw: raw, edits: w.edits}
+	if len(w.edits) > 0 {
+		var b bytes.Buffer
+		var last int64
+		for _, e := range w.edits {
+			b.Write(raw[last:e.start])
+			b.WriteString(e.text)
+			last = e.end
+		}
+		b.Write(raw[last:])
+		x.raw = b.Bytes()
+	}
+	return x, nil
+}
+
+// An exprWalker walks a JSON document alongside the Go type it will be
+// decoded into, evaluating strings where numbers belong.
+type exprWalker struct {
+	raw   []byte
+	dec   *json.Decoder
+	vars  map[string]float64
+	edits []edit
+}
+
+// readVars reads the vars object that starts at off.
+func (w *exprWalker) readVars(off int64) error {
+	dec := json.NewDecoder(bytes.NewReader(w.raw[off:]))
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('{') {
+		return nil // leave the error to the decoder
+	}
+	for dec.More() {
+		k, err := dec.Token()
+		if err != nil {
+			return nil
+		}
+		start := nextToken(w.raw, off+dec.InputOffset())
+		v, err := dec.Token()
+		if err != nil {
+			return nil
+		}
+		name := k.(string)
+		switch v := v.(type) {
+		case float64:
+			w.vars[name] = v
+		case string:
+			f, err := evalExpr(v, w.vars)
+			if err != nil {
+				return &decodeError{start + 1, err}
+			}
+			w.vars[name] = f
+		default:
+			return &decodeError{start + 1, fmt.Errorf("variable %s must be a number or an expression", name)}
+		}
+	}
+	return nil
+}
+
+var vec3Type = reflect.TypeOf(Vec3{})
+
+func (w *exprWalker) value(t reflect.Type) error {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t == vec3Type {
+		t = reflect.TypeOf([]float64(nil))
+	}
+	start := nextToken(w.raw, w.dec.InputOffset())
+	tok, err := w.dec.Token()
+	if err != nil {
+		return nil // leave the error to the decoder
+	}
+	switch t.Kind() {
+	case reflect.Float32, reflect.Float64,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		s, ok := tok.(string)
+		if !ok {
+			break
+		}
+		v, err := evalExpr(s, w.vars)
+		if err != nil {
+			return &decodeError{start + 1, err}
+		}
+		text := strconv.FormatFloat(v, 'g', -1, 64)
+		if t.Kind() != reflect.Float32 && t.Kind() != reflect.Float64 {
+			if v != math.Trunc(v) || math.Abs(v) > 1<<53 {
+				return &decodeError{start + 1, fmt.Errorf("%q is %g, not a whole number", s, v)}
+			}
+			text = strconv.FormatInt(int64(v), 10)
+		}
+		w.edits = append(w.edits, edit{start, w.dec.InputOffset(), text})
+		return nil
+	case reflect.Struct, reflect.Map:
+		if tok != json.Delim('{') || reflect.PtrTo(t).Implements(unmarshalerType) {
+			break
+		}
+		var fields map[string]reflect.Type
+		if t.Kind() == reflect.Struct {
+			fields = make(map[string]reflect.Type)
+			jsonFields(t, fields)
+		}
+		for w.dec.More() {
+			k, err := w.dec.Token()
+			if err != nil {
+				return nil
+			}
+			elem := reflect.TypeOf((*interface{})(nil)).Elem()
+			if fields == nil {
+				elem = t.Elem()
+			} else if ft, ok := fields[strings.ToLower(k.(string))]; ok {
+				elem = ft
+			}
+			if err := w.value(elem); err != nil {
+				return err
+			}
+		}
+		w.dec.Token()
+		return nil
+	case reflect.Slice, reflect.Array:
+		if tok != json.Delim('[') {
+			break
+		}
+		for w.dec.More() {
+			if err := w.value(t.Elem()); err != nil {
+				return err
+			}
+		}
+		w.dec.Token()
+		return nil
+	}
+	// Skip the rest of anything else.
+	if d, ok := tok.(json.Delim); ok && (d == '{' || d == '[') {
+		depth := 1
+		for depth > 0 {
+			tok, err := w.dec.Token()
+			if err != nil {
+				return nil
+			}
+			switch tok {
+			case json.Delim('{'), json.Delim('['):
+				depth++
+			case json.Delim('}'), json.Delim(']'):
+				depth--
+			}
+		}
+	}
+	return nil
+}
+
+// evalExpr evaluates the expression s with the given variables.
+func evalExpr(s string, vars map[string]float64) (float64, error) {
+	p := &exprParser{s: s, vars: vars}
+	v, err := p.expr()
+	if err == nil {
+		p.space()
+		if p.pos < len(p.s) {
+			err = p.errorf("unexpected %q", p.s[p.pos:])
+		}
+	}
+	if err != nil {
+		return 0, fmt.Errorf("bad expression %q: %s", s, err)
+	}
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		return 0, fmt.Errorf("expression %q is %g", s, v)
+	}
+	return v, nil
+}
+
+// An exprParser evaluates an expression by recursive descent.
+type exprParser struct {
+	s    string
+	pos  int
+	vars map[string]float64
+}
+
+func (p *exprParser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("at position %d: %s", p.pos+1, fmt.Sprintf(format, args...))
+}
+
+func (p *exprParser) space() {
+	for p.pos < len(p.s) && p.s[p.pos] == ' ' {
+		p.pos++
+	}
+}
+
+// peek skips spaces and returns the next byte, or 0 at the end.
+func (p *exprParser) peek() byte {
+	p.space()
+	if p.pos == len(p.s) {
+		return 0
+	}
+	return p.s[p.pos]
+}
+
+// expr := term {("+" | "-") term}
+func (p *exprParser) expr() (float64, error) {
+	v, err := p.term()
+	for err == nil {
+		op := p.peek()
+		if op != '+' && op != '-' {
+			break
+		}
+		p.pos++
+		var w float64
+		if w, err = p.term(); op == '+' {
+			v += w
+		} else {
+			v -= w
+		}
+	}
+	return v, err
+}
+
+// term := unary {("*" | "/" | "%") unary}
+func (p *exprParser) term() (float64, error) {
+	v, err := p.unary()
+	for err == nil {
+		op := p.peek()
+		if op != '*' && op != '/' && op != '%' {
+			break
+		}
+		p.pos++
+		var w float64
+		w, err = p.unary()
+		switch op {
+		case '*':
+			v *= w
+		case '/':
+			v /= w
+		case '%':
+			v = math.Mod(v, w)
+		}
+	}
+	return v, err
+}
+
+// unary := ("-" | "+") unary | power
+func (p *exprParser) unary() (float64, error) {
+	switch p.peek() {
+	case '-':
+		p.pos++
+		v, err := p.unary()
+		return -v, err
+	case '+':
+		p.pos++
+		return p.unary()
+	}
+	return p.power()
+}
+
+// power := primary ["^" unary]
+func (p *exprParser) power() (float64, error) {
+	v, err := p.primary()
+	if err != nil || p.peek() != '^' {
+		return v, err
+	}
+	p.pos++
+	w, err := p.unary()
+	return math.Pow(v, w), err
+}
+
+// primary := number | "$" name | name | name "(" expr {"," expr} ")" | "(" expr ")"
+func (p *exprParser) primary() (float64, error) {
+	c := p.peek()
+	switch {
+	case c == '(':
+		p.pos++
+		v, err := p.expr()
+		if err != nil {
+			return 0, err
+		}
+		if p.peek() != ')' {
+			return 0, p.errorf("missing )")
+		}
+		p.pos++
+		return v, nil
+	case c == '$':
+		start := p.pos
+		p.pos++
+		name := p.name()
+		v, ok := p.vars[name]
+		if !ok {
+			p.pos = start
+			return 0, p.errorf("unknown variable $%s", name)
+		}
+		return v, nil
+	case c == '.' || c >= '0' && c <= '9':
+		start := p.pos
+		for p.pos < len(p.s) && strings.IndexByte("0123456789.eE", p.s[p.pos]) >= 0 {
+			// Allow a sign in an exponent.
+			if (p.s[p.pos] == 'e' || p.s[p.pos] == 'E') && p.pos+1 < len(p.s) &&
+				(p.s[p.pos+1] == '-' || p.s[p.pos+1] == '+') {
+				p.pos++
+			}
+			p.pos++
+		}
+		num := p.s[start:p.pos]
+		v, err := strconv.ParseFloat(num, 64)
+		if err != nil {
+			p.pos = start
+			return 0, p.errorf("bad number %q", num)
+		}
+		return v, nil
+	case unicode.IsLetter(rune(c)):
+		start := p.pos
+		name := p.name()
+		if p.peek() != '(' {
+			if name == "pi" {
+				return math.Pi, nil
+			}
+			p.pos = start
+			return 0, p.errorf("unknown name %s (variables start with $)", name)
+		}
+		p.pos++
+		var args []float64
+		for {
+			v, err := p.expr()
+			if err != nil {
+				return 0, err
+			}
+			args = append(args, v)
+			if p.peek() != ',' {
+				break
+			}
+			p.pos++
+		}
+		if p.peek() != ')' {
+			return 0, p.errorf("missing )")
+		}
+		p.pos++
+		return callFunc(name, args)
+	case c == 0:
+		return 0, p.errorf("unexpected end")
+	}
+	return 0, p.errorf("unexpected %q", c)
+}
+
+func (p *exprParser) name() string {
+	start := p.pos
+	for p.pos < len(p.s) {
+		c := rune(p.s[p.pos])
+		if !unicode.IsLetter(c) && !unicode.IsDigit(c) && c != '_' {
+			break
+		}
+		p.pos++
+	}
+	return p.s[start:p.pos]
+}
+
+const degrees = math.Pi / 180
+
+// exprFuncs are the functions available in expressions, by name.
+var exprFuncs = map[string]struct {
+	nargs int
+	f     func(a []float64) float64
+}{
+	"sin":   {1, func(a []float64) float64 { return math.Sin(a[0] * degrees) }},
+	"cos":   {1, func(a []float64) float64 { return math.Cos(a[0] * degrees) }},
+	"tan":   {1, func(a []float64) float64 { return math.Tan(a[0] * degrees) }},
+	"asin":  {1, func(a []float64) float64 { return math.Asin(a[0]) / degrees }},
+	"acos":  {1, func(a []float64) float64 { return math.Acos(a[0]) / degrees }},
+	"atan":  {1, func(a []float64) float64 { return math.Atan(a[0]) / degrees }},
+	"atan2": {2, func(a []float64) float64 { return math.Atan2(a[0], a[1]) / degrees }},
+	"sqrt":  {1, func(a []float64) float64 { return math.Sqrt(a[0]) }},
+	"abs":   {1, func(a []float64) float64 { return math.Abs(a[0]) }},
+	"floor": {1, func(a []float64) float64 { return math.Floor(a[0]) }},
+	"ceil":  {1, func(a []float64) float64 { return math.Ceil(a[0]) }},
+	"round": {1, func(a []float64) float64 { return math.Round(a[0]) }},
+	"min":   {2, func(a []float64) float64 { return math.Min(a[0], a[1]) }},
+	"max":   {2, func(a []float64) float64 { return math.Max(a[0], a[1]) }},
+	"pow":   {2, func(a []float64) float64 { return math.Pow(a[0], a[1]) }},
+	"exp":   {1, func(a []float64) float64 { return math.Exp(a[0]) }},
+	"log":   {1, func(a []float64) float64 { return math.Log(a[0]) }},
+}
+
+func callFunc(name string, args []float64) (float64, error) {
+	fn, ok := exprFuncs[name]
+	if !ok {
+		return 0, fmt.Errorf("unknown function %s", name)
+	}
+	if len(args) != fn.nargs {
+		return 0, fmt.Errorf("%s takes %d arguments; got %d", name, fn.nargs, len(args))
+	}
+	return fn.f(args), nil
+}
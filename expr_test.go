@@ -0,0 +1,153 @@
+package main
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestEvalExpr(t *testing.T) {
+	vars := map[string]float64{"a": 3, "b_2": -0.5}
+	for _, tt := range []struct {
+		s    string
+		want float64
+	}{
+		{"42", 42},
+		{"1.5e2", 150},
+		{"2e-1", 0.2},
+		{"1 + 2*3", 7},
+		{"(1 + 2) * 3", 9},
+		{"10 - 4 - 3", 3},
+		{"12 / 3 / 2", 2},
+		{"7 % 4", 3},
+		{"-2^2", -4},
+		{"(-2)^2", 4},
+		{"2^3^2", 512},
+		{"2^-1", 0.5},
+		{"--3", 3},
+		{"+3", 3},
+		{"2*pi", 2 * math.Pi},
+		{"$a * 2 + $b_2", 5.5},
+		{"-$a^2", -9},
+		{"sin(30)", 0.5},
+		{"cos(60)", 0.5},
+		{"tan(45)", 1},
+		{"asin(1)", 90},
+		{"acos(0)", 90},
+		{"atan(1)", 45},
+		{"atan2(1, -1)", 135},
+		{"sqrt(16) + abs(-2)", 6},
+		{"floor(2.7) + ceil(2.2) + round(2.5)", 8},
+		{"min(1, $a) + max(1, $a)", 4},
+		{"pow(2, 10)", 1024},
+		{"log(exp(2))", 2},
+		{" 1 +  ( 2 ) ", 3},
+	} {
+		got, err := evalExpr(tt.s, vars)
+		if err != nil {
+			t.Errorf("evalExpr(%q): %s", tt.s, err)
+			continue
+		}
+		if math.Abs(got-tt.want) > 1e-9 {
+			t.Errorf("evalExpr(%q) = %g; want %g", tt.s, got, tt.want)
+		}
+	}
+}
+
+func TestEvalExprErrors(t *testing.T) {
+	vars := map[string]float64{"a": 3}
+	for _, tt := range []struct {
+		s    string
+		want string
+	}{
+		{"1 + $b", `bad expression "1 + $b": at position 5: unknown variable $b`},
+		{"2*x", `bad expression "2*x": at position 3: unknown name x (variables start with $)`},
+		{"1 +", `bad expression "1 +": at position 4: unexpected end`},
+		{"(1 + 2", `bad expression "(1 + 2": at position 7: missing )`},
+		{"1 2", `bad expression "1 2": at position 3: unexpected "2"`},
+		{"1..2", `bad expression "1..2": at position 1: bad number "1..2"`},
+		{"foo(1)", `bad expression "foo(1)": unknown function foo`},
+		{"sin(1, 2)", `bad expression "sin(1, 2)": sin takes 1 arguments; got 2`},
+		{"1/0", `expression "1/0" is +Inf`},
+		{"sqrt(-$a)", `expression "sqrt(-$a)" is NaN`},
+	} {
+		_, err := evalExpr(tt.s, vars)
+		if err == nil {
+			t.Errorf("evalExpr(%q): got no error; want %s", tt.s, tt.want)
+			continue
+		}
+		if err.Error() != tt.want {
+			t.Errorf("evalExpr(%q): got error\n  %s\nwant\n  %s", tt.s, err, tt.want)
+		}
+	}
+}
+
+func TestExpansionOrigOffset(t *testing.T) {
+	// The edits are shorter and longer than what they replace.
+	raw := []byte(`{"vars": {"x": "2*3"}, "a": [1, "2+3", 4, "10*10*10", 5, "$x", 6]}`)
+	typ := reflect.TypeOf(struct {
+		Vars map[string]float64
+		A    []float64
+	}{})
+	x, err := expandExprs(raw, typ)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(x.raw), `{"vars": {"x": 6}, "a": [1, 5, 4, 1000, 5, 6, 6]}`; got != want {
+		t.Fatalf("expanded to %s; want %s", got, want)
+	}
+	for i := 0; i < 7; i++ {
+		path := jsonPath{"a", i}
+		orig, ok := jsonOffset(raw, path)
+		if !ok {
+			t.Fatalf("cannot find %s in the original", path)
+		}
+		expanded, ok := jsonOffset(x.raw, path)
+		if !ok {
+			t.Fatalf("cannot find %s in the expansion", path)
+		}
+		if got := x.origOffset(expanded + 1); got != orig+1 {
+			t.Errorf("origOffset(%d) (at %s) = %d; want %d", expanded+1, path, got, orig+1)
+		}
+	}
+}
+
+func TestExpansionErrorPosition(t *testing.T) {
+	// An unknown field after several expressions, on several lines, is
+	// reported where it is in the original file.
+	raw := []byte(`{
+  "vars": {"s": 2, "big": "$s * 1000"},
+  "camera": {"loc": {"v": ["$s*10", "1 + 1 + 1 + 1", 0], "d": [0, 0, "-$s"]},
+    "width": "sqrt(4)", "haov": "$big / 20", "aspect": 1},
+  "ambient": "#333", "bogus": "$s"
+}`)
+	s := &Scene{}
+	x, err := expandExprs(raw, reflect.TypeOf(s))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = decodeStrict(x.raw, s)
+	if err == nil {
+		t.Fatal("got no error for an unknown field")
+	}
+	got := jsonError(raw, x.origError(err)).Error()
+	want := `JSON error at line 5, column 22: unknown field "bogus"`
+	if got != want {
+		t.Errorf("got error\n  %s\nwant\n  %s", got, want)
+	}
+
+	// An error in an expression is reported at the expression.
+	raw = []byte(`{
+  "vars": {"s": 2},
+  "camera": {"loc": {"v": ["$s*10", 0, 0], "d": [0, 0, "-$t"]}}
+}`)
+	_, err = expandExprs(raw, reflect.TypeOf(s))
+	if err == nil {
+		t.Fatal("got no error for an unknown variable")
+	}
+	got = jsonError(raw, err).Error()
+	want = `JSON error at line 3, column 56: bad expression "-$t": at position 2: unknown variable $t`
+	if got != want {
+		t.Errorf("got error\n  %s\nwant\n  %s", got, want)
+	}
+}
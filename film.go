@@ -0,0 +1,93 @@
+package main
+
+import (
+	"math"
+)
+
+// A Film accumulates image samples. Each sample is splatted onto every pixel
+// within the filter radius, weighted by the filter.
+type Film struct {
+	Width, Height int
+
+	filter Filter
+	sum    []Color
+	weight []float64
+}
+
+func NewFilm(width, height int, filter Filter) *Film {
+	return &Film{
+		Width:  width,
+		Height: height,
+		filter: filter,
+		sum:    make([]Color, width*height),
+		weight: make([]float64, width*height),
+	}
+}
+
+// A filmSample is a single sample at (x, y), in the continuous pixel
+// coordinates used by LineScanner.RayAt.
+type filmSample struct {
+	x, y float64
+	c    Color
+}
+
+// AddSample splats a sample at (x, y) with color c.
+func (f *Film) AddSample(x, y float64, c Color) {
+	r := f.filter.Radius()
+	// Pixel (px, py) has its center at (px+0.5, py+0.5).
+	x0 := int(math.Ceil(x - 0.5 - r))
+	x1 := int(math.Floor(x - 0.5 + r))
+	y0 := int(math.Ceil(y - 0.5 - r))
+	y1 := int(math.Floor(y - 0.5 + r))
+	if x0 < 0 {
+		x0 = 0
+	}
+	if y0 < 0 {
+		y0 = 0
+	}
+	if x1 >= f.Width {
+		x1 = f.Width - 1
+	}
+	if y1 >= f.Height {
+		y1 = f.Height - 1
+	}
+	for py := y0; py <= y1; py++ {
+		for px := x0; px <= x1; px++ {
+			w := f.filter.Eval(x-float64(px)-0.5, y-float64(py)-0.5)
+			if w == 0 {
+				continue
+			}
+			i := py*f.Width + px
+			f.sum[i] = f.sum[i].Add(c.MulS(w))
+			f.weight[i] += w
+		}
+	}
+}
+
+// splat adds all the samples received on ch to f, returning once ch is
+// closed.
+func (f *Film) splat(ch <-chan []filmSample) {
+	for samples := range ch {
+		for _, s := range samples {
+			f.AddSample(s.x, s.y, s.c)
+		}
+	}
+}
+
+// Image resolves the film to an Image. Filters with negative lobes can produce
+// negative values, so each channel is clamped at zero.
+func (f *Film) Image() *Image {
+	img := NewImage(f.Width, f.Height)
+	for i, w := range f.weight {
+		if w <= 0 {
+			continue
+		}
+		c := f.sum[i].MulS(1 / w)
+		img.Pix[i] = Color{
+			R: math.Max(0, c.R),
+			G: math.Max(0, c.G),
+			B: math.Max(0, c.B),
+		}
+	}
+	return img
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"math"
+)
+
+// A Filter is a reconstruction filter used to weight the contribution of an
+// image sample to the pixels around it. The filter is centered on a pixel
+// center and is zero for offsets (in pixels) outside of [-Radius, Radius] in
+// either dimension.
+type Filter interface {
+	Radius() float64
+	Eval(dx, dy float64) float64
+}
+
+// NewFilter constructs the named filter (one of box, tent, gaussian,
+// mitchell, or lanczos). If radius is 0, the filter's default radius is
+// used.
+func NewFilter(name string, radius float64) (Filter, error) {
+	if radius < 0 {
+		return nil, fmt.Errorf("bad filter radius %g", radius)
+	}
+	def := func(r float64) float64 {
+		if radius == 0 {
+			return r
+		}
+		return radius
+	}
+	switch name {
+	case "box":
+		return BoxFilter{def(0.5)}, nil
+	case "tent":
+		return TentFilter{def(1)}, nil
+	case "gaussian":
+		return GaussianFilter{def(1.5), 2}, nil
+	case "mitchell":
+		return MitchellFilter{def(2), 1.0 / 3, 1.0 / 3}, nil
+	case "lanczos":
+		return LanczosFilter{def(2), 2}, nil
+	}
+	return nil, fmt.Errorf("unknown filter %q", name)
+}
+
+// A BoxFilter weights all samples within its radius equally. With a radius of
+// 0.5 this is a plain average of the samples inside each pixel.
+type BoxFilter struct {
+	R float64
+}
+
+func (f BoxFilter) Radius() float64 { return f.R }
+
+func (f BoxFilter) Eval(dx, dy float64) float64 {
+	if math.Abs(dx) > f.R || math.Abs(dy) > f.R {
+		return 0
+	}
+	return 1
+}
+
+// A TentFilter falls off linearly from the pixel center.
+type TentFilter struct {
+	R float64
+}
+
+func (f TentFilter) Radius() float64 { return f.R }
+
+func (f TentFilter) Eval(dx, dy float64) float64 {
+	return math.Max(0, f.R-math.Abs(dx)) * math.Max(0, f.R-math.Abs(dy))
+}
+
+// A GaussianFilter is a Gaussian, exp(-Alpha * x²), shifted down so that it
+// reaches zero at the radius.
+type GaussianFilter struct {
+	R     float64
+	Alpha float64
+}
+
+func (f GaussianFilter) Radius() float64 { return f.R }
+
+func (f GaussianFilter) Eval(dx, dy float64) float64 {
+	return f.gaussian(dx) * f.gaussian(dy)
+}
+
+func (f GaussianFilter) gaussian(d float64) float64 {
+	return math.Max(0, math.Exp(-f.Alpha*d*d)-math.Exp(-f.Alpha*f.R*f.R))
+}
+
+// A MitchellFilter is the Mitchell-Netravali cubic filter with parameters B
+// and C (1/3 and 1/3 are the recommended values). It has small negative
+// lobes, which sharpen edges.
+type MitchellFilter struct {
+	R    float64
+	B, C float64
+}
+
+func (f MitchellFilter) Radius() float64 { return f.R }
+
+func (f MitchellFilter) Eval(dx, dy float64) float64 {
+	return f.mitchell(dx/f.R) * f.mitchell(dy/f.R)
+}
+
+// mitchell evaluates the filter for x in [-1, 1] (the canonical cubic is
+// defined over [-2, 2]).
+func (f MitchellFilter) mitchell(x float64) float64 {
+	x = math.Abs(2 * x)
+	b, c := f.B, f.C
+	switch {
+	case x > 2:
+		return 0
+	case x > 1:
+		return ((-b-6*c)*x*x*x + (6*b+30*c)*x*x + (-12*b-48*c)*x + (8*b + 24*c)) / 6
+	}
+	return ((12-9*b-6*c)*x*x*x + (-18+12*b+6*c)*x*x + (6 - 2*b)) / 6
+}
+
+// A LanczosFilter is a sinc filter windowed by a wider sinc. Tau is the
+// number of sinc lobes within the radius.
+type LanczosFilter struct {
+	R   float64
+	Tau float64
+}
+
+func (f LanczosFilter) Radius() float64 { return f.R }
+
+func (f LanczosFilter) Eval(dx, dy float64) float64 {
+	return f.lanczos(dx/f.R) * f.lanczos(dy/f.R)
+}
+
+func (f LanczosFilter) lanczos(x float64) float64 {
+	x = math.Abs(x)
+	if x > 1 {
+		return 0
+	}
+	return sinc(x*f.Tau) * sinc(x)
+}
+
+func sinc(x float64) float64 {
+	if x < 1e-5 {
+		return 1
+	}
+	x *= math.Pi
+	return math.Sin(x) / x
+}
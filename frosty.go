@@ -1,13 +1,13 @@
 package main
 
 import (
-	"bytes"
 	"encoding/json"
 	"flag"
 	"fmt"
+	"image"
 	"image/png"
-	"io/ioutil"
 	"log"
+	"math/rand"
 	"os"
 	"regexp"
 	"runtime"
@@ -15,15 +15,19 @@ import (
 )
 
 func jsonError(raw []byte, err error) error {
-	e, ok := err.(*json.SyntaxError)
-	if !ok {
+	var offset int64
+	switch e := err.(type) {
+	case *json.SyntaxError:
+		offset = e.Offset
+	case *json.UnmarshalTypeError:
+		offset = e.Offset
+	case *decodeError:
+		offset = e.offset
+	default:
 		return err
 	}
-	first := raw[:e.Offset]
-	newlines := bytes.Count(first, []byte{'\n'})
-	last := bytes.LastIndex(first, []byte{'\n'})
-	return fmt.Errorf("JSON error at line %d, column %d: %s",
-		newlines+1, len(first)-last-1, e)
+	line, col := lineCol(raw, offset)
+	return fmt.Errorf("JSON error at line %d, column %d: %s", line, col, err)
 }
 
 var jsonCommentRegex = regexp.MustCompile(`(?m)^\s+(//|#).*$`)
@@ -46,9 +50,21 @@ func main() {
 		out           = flag.String("out", "render.png", "Output png image")
 		debug         = flag.Bool("debug", false, "Print verbose debugging information")
 		supersampling = flag.Int("supersampling", 1, "Supersampling (antialiasing) factor")
+		filterName    = flag.String("filter", "box", "Reconstruction filter: box, tent, gaussian, mitchell, or lanczos")
+		filterRadius  = flag.Float64("filterradius", 0, "Reconstruction filter radius in pixels (0 means the filter's default)")
+		integrator    = flag.String("integrator", "whitted", "Shading: whitted (direct light and ambient) or path (path tracing)")
+		spp           = flag.Int("spp", 1, "Samples per pixel (per supersampling grid cell when -supersampling > 1)")
+		maxDepth      = flag.Int("maxdepth", 8, "Maximum number of bounces for -integrator path")
+		aoOut         = flag.String("aoout", "", "If given, also render the raw ambient occlusion buffer to this png")
 		// Default value of 4 * numcpu is based on some ad hoc testing.
 		parallelism = flag.Int("parallelism", 4*runtime.NumCPU(), "Number of rays to compute in parallel")
 		cpuProfile  = flag.Bool("cpuprofile", false, "Emit CPU profile")
+
+		adaptive   = flag.Bool("adaptive", false, "Use adaptive supersampling (instead of -supersampling)")
+		minSamples = flag.Int("minsamples", 4, "Initial samples per pixel (and samples per refinement pass) for -adaptive")
+		maxSamples = flag.Int("maxsamples", 64, "Maximum samples per pixel for -adaptive")
+		threshold  = flag.Float64("threshold", 0.05, "Relative variance/contrast above which -adaptive refines a pixel")
+		heatmap    = flag.String("heatmap", "", "If given, write a png heatmap of samples per pixel for -adaptive")
 	)
 	flag.Parse()
 	_ = *debug
@@ -56,7 +72,27 @@ func main() {
 	if *supersampling < 1 || *supersampling > 8 {
 		log.Fatalf("Supersampling should be between 1 and 8; got %d", *supersampling)
 	}
-	*hpixels *= *supersampling
+	if *adaptive {
+		if *supersampling > 1 {
+			log.Fatalln("-adaptive and -supersampling are mutually exclusive")
+		}
+		if *minSamples < 1 || *maxSamples < *minSamples {
+			log.Fatalf("Need 1 <= minsamples <= maxsamples; got %d and %d", *minSamples, *maxSamples)
+		}
+	} else if *heatmap != "" {
+		log.Fatalln("-heatmap requires -adaptive")
+	}
+	filter, err := NewFilter(*filterName, *filterRadius)
+	if err != nil {
+		log.Fatalln("Bad filter:", err)
+	}
+
+	if *spp < 1 {
+		log.Fatalf("Bad value for spp (should be at least one): %d", *spp)
+	}
+	if *maxDepth < 0 {
+		log.Fatalf("Bad value for maxdepth: %d", *maxDepth)
+	}
 
 	if *parallelism < 1 {
 		log.Fatalf("Bad value for parallelism (should be at least one): %d", *parallelism)
@@ -78,49 +114,98 @@ func main() {
 		}()
 	}
 
-	raw, err := ioutil.ReadFile(*sceneFile)
-	if err != nil {
-		log.Fatalf("Cannot open scene file %s: %s", *sceneFile, err)
-	}
-	filterJSONComments(raw)
-
 	fmt.Printf("Loading scene...")
-	scene := &Scene{}
-	if err := json.Unmarshal(raw, scene); err != nil {
-		log.Fatalf("\nError loading scene: %s", jsonError(raw, err))
+	scene, err := LoadScene(*sceneFile)
+	if err != nil {
+		log.Fatalf("\nError loading scene: %s", err)
 	}
 	fmt.Println("done")
 
 	fmt.Printf("Initializing primitives...")
 	if err := scene.Initialize(); err != nil {
-		fmt.Printf("\nError: %s\n", err)
+		log.Fatalf("\nError initializing scene: %s", err)
 	}
 	fmt.Println("done")
 
-	fmt.Printf("Rendering...")
-	rendering := &Rendering{scene, *hpixels}
-	img := rendering.Render(*parallelism)
-	fmt.Println("done.")
+	if scene.Photons != nil {
+		fmt.Printf("Tracing photons...")
+		scene.BuildPhotonMap(rand.New(rand.NewSource(1)))
+		fmt.Println("done")
+	}
 
-	if *supersampling > 1 {
-		fmt.Printf("Downsampling supersampled image...")
-		img, err = Downsample(img, *supersampling)
-		if err != nil {
-			log.Fatalf("\nerror downsampling: %s", err)
+	integ, err := NewIntegrator(*integrator, scene, *maxDepth)
+	if err != nil {
+		log.Fatalln("Bad integrator:", err)
+	}
+	rendering := &Rendering{
+		Scene:         scene,
+		HPixels:       *hpixels,
+		Integrator:    integ,
+		Supersampling: *supersampling,
+		Samples:       *spp,
+		Filter:        filter,
+	}
+	sampler := &AdaptiveSampler{
+		MinSamples: *minSamples,
+		MaxSamples: *maxSamples,
+		Threshold:  *threshold,
+	}
+	var img *Image
+	if *adaptive {
+		fmt.Printf("Rendering adaptively...")
+		var counts []int
+		img, counts = rendering.RenderAdaptive(*parallelism, sampler)
+		fmt.Println("done.")
+		if *heatmap != "" {
+			hm := SampleHeatmap(counts, img.Width, img.Height, *minSamples, *maxSamples)
+			if err := writePNG(*heatmap, hm); err != nil {
+				log.Fatalf("Cannot write sample heatmap: %s", err)
+			}
+			fmt.Printf("Sample heatmap written to %s\n", *heatmap)
 		}
-		fmt.Println("done")
+	} else {
+		fmt.Printf("Rendering...")
+		img = rendering.Render(*parallelism)
+		fmt.Println("done.")
+	}
+
+	if *aoOut != "" {
+		fmt.Printf("Rendering ambient occlusion...")
+		ao := scene.AO
+		if ao == nil {
+			ao = defaultAO
+		}
+		rendering.Integrator = AOIntegrator{scene, ao}
+		var aoImg *Image
+		if *adaptive {
+			aoImg, _ = rendering.RenderAdaptive(*parallelism, sampler)
+		} else {
+			aoImg = rendering.Render(*parallelism)
+		}
+		if err := writePNG(*aoOut, aoImg.Gray()); err != nil {
+			log.Fatalf("\nCannot write ambient occlusion buffer: %s", err)
+		}
+		fmt.Printf("done (written to %s).\n", *aoOut)
 	}
 
 	fmt.Printf("Tone mapping image...")
 	outImg := img.ToneMap()
 	fmt.Println("done.")
 
-	f, err := os.Create(*out)
+	if err := writePNG(*out, outImg); err != nil {
+		log.Fatalf("Cannot write rendering: %s", err)
+	}
+	fmt.Printf("Image rendered to %s\n", *out)
+}
+
+func writePNG(name string, img image.Image) error {
+	f, err := os.Create(name)
 	if err != nil {
-		log.Fatalf("Cannot open output file %s: %s", *out, err)
+		return err
 	}
-	if err := png.Encode(f, outImg); err != nil {
-		log.Fatalf("Cannot write rendering as png: %s", err)
+	if err := png.Encode(f, img); err != nil {
+		f.Close()
+		return err
 	}
-	fmt.Printf("Image rendered to %s\n", *out)
+	return f.Close()
 }
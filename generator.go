@@ -0,0 +1,203 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+)
+
+// A Generator places copies of an object (an RPrism, a Sphere, or an
+// Instance of a group) in a pattern. Each copy is the object moved by an
+// offset, which depends on Type:
+//
+//   - "repeat": Count copies, each Offset from the one before (the first
+//     is not moved)
+//   - "grid": NX by NY by NZ copies, Spacing apart along X, Y, and Z
+//   - "scatter": Count copies at random offsets, chosen using Seed, such
+//     that each copy's bounding box is inside the box from Min to Max. If
+//     NoOverlap is set, the copies' bounding boxes don't overlap.
+type Generator struct {
+	Type string
+
+	RPrism   *RPrism
+	Sphere   *Sphere
+	Instance *Instance
+
+	Count  int
+	Offset Vec3
+
+	NX, NY, NZ int
+	Spacing    Vec3
+
+	Seed      int64
+	Min, Max  Vec3
+	NoOverlap bool
+}
+
+// maxCopies limits the number of copies a generator makes, to catch typos
+// that would otherwise exhaust memory.
+const maxCopies = 1 << 20
+
+// scatterTries is how many random offsets a scatter generator tries for
+// each copy before giving up on fitting it in without overlap.
+const scatterTries = 1000
+
+func (g *Generator) validate() error {
+	n := 0
+	for _, set := range []bool{g.RPrism != nil, g.Sphere != nil, g.Instance != nil} {
+		if set {
+			n++
+		}
+	}
+	if n != 1 {
+		return errors.New("generator needs exactly one of rprism, sphere, and instance")
+	}
+	switch g.Type {
+	case "repeat":
+		if g.Count < 1 || g.Count > maxCopies {
+			return fmt.Errorf("repeat count must be between 1 and %d; got %d", maxCopies, g.Count)
+		}
+	case "grid":
+		if g.NX < 1 || g.NY < 1 || g.NZ < 1 {
+			return fmt.Errorf("grid needs nx, ny, and nz of at least 1; got %d, %d, and %d", g.NX, g.NY, g.NZ)
+		}
+		if g.NX > maxCopies || g.NY > maxCopies/g.NX || g.NZ > maxCopies/(g.NX*g.NY) {
+			return fmt.Errorf("grid of %d by %d by %d has more than %d copies", g.NX, g.NY, g.NZ, maxCopies)
+		}
+	case "scatter":
+		if g.Count < 1 || g.Count > maxCopies {
+			return fmt.Errorf("scatter count must be between 1 and %d; got %d", maxCopies, g.Count)
+		}
+		if g.Min.X > g.Max.X || g.Min.Y > g.Max.Y || g.Min.Z > g.Max.Z {
+			return fmt.Errorf("scatter region min %v is not below max %v", g.Min, g.Max)
+		}
+	default:
+		return fmt.Errorf("unknown generator type %q", g.Type)
+	}
+	return nil
+}
+
+// offsets returns the offsets of g's copies. For scatter generators, bounds
+// is the bounding box of the object before it is moved.
+func (g *Generator) offsets(bounds AABB) ([]Vec3, error) {
+	var offsets []Vec3
+	switch g.Type {
+	case "repeat":
+		for i := 0; i < g.Count; i++ {
+			offsets = append(offsets, g.Offset.Mul(float64(i)))
+		}
+	case "grid":
+		for i := 0; i < g.NX; i++ {
+			for j := 0; j < g.NY; j++ {
+				for k := 0; k < g.NZ; k++ {
+					offsets = append(offsets, Vec3{
+						float64(i) * g.Spacing.X,
+						float64(j) * g.Spacing.Y,
+						float64(k) * g.Spacing.Z,
+					})
+				}
+			}
+		}
+	case "scatter":
+		// Offsets between lo and hi keep the object inside the region. A
+		// region that fits the object exactly (give or take rounding) leaves
+		// no room to move along that axis.
+		lo, hi := g.Min.Sub(bounds.Min), g.Max.Sub(bounds.Max)
+		size := bounds.Max.Sub(bounds.Min)
+		ext := hi.Sub(lo)
+		const eps = 1e-9
+		if ext.X < -eps || ext.Y < -eps || ext.Z < -eps {
+			return nil, fmt.Errorf("object of size %v doesn't fit in the scatter region", size)
+		}
+		ext = Vec3{math.Max(0, ext.X), math.Max(0, ext.Y), math.Max(0, ext.Z)}
+		rng := rand.New(rand.NewSource(g.Seed))
+	copies:
+		for len(offsets) < g.Count {
+			for try := 0; try < scatterTries; try++ {
+				d := lo.Add(Vec3{rng.Float64() * ext.X, rng.Float64() * ext.Y, rng.Float64() * ext.Z})
+				if g.NoOverlap && overlapsAny(d, offsets, size) {
+					continue
+				}
+				offsets = append(offsets, d)
+				continue copies
+			}
+			return nil, fmt.Errorf("could only fit %d of %d copies without overlap", len(offsets), g.Count)
+		}
+	}
+	return offsets, nil
+}
+
+// overlapsAny reports whether boxes of the given size at offset d and at any
+// of offsets overlap.
+func overlapsAny(d Vec3, offsets []Vec3, size Vec3) bool {
+	for _, o := range offsets {
+		s := d.Sub(o)
+		if math.Abs(s.X) < size.X && math.Abs(s.Y) < size.Y && math.Abs(s.Z) < size.Z {
+			return true
+		}
+	}
+	return false
+}
+
+// generate builds the copies of the generator g, found at path in the
+// scene, where mat is the default material.
+func (b *groupBuilder) generate(path jsonPath, g *Generator, mat string) []Object {
+	var bounds AABB
+	if g.Type == "scatter" {
+		// Find the extent of the object by building one unmoved copy.
+		o := b.generated(path, g, mat, Vec3{})
+		if o == nil {
+			return nil
+		}
+		bounds = o.Bounds()
+		if !bounds.bounded() {
+			b.errs.report(path, errors.New("cannot scatter an unbounded object"))
+			return nil
+		}
+	}
+	offsets, err := g.offsets(bounds)
+	if err != nil {
+		b.errs.report(path, err)
+		return nil
+	}
+	var objects []Object
+	for _, d := range offsets {
+		o := b.generated(path, g, mat, d)
+		if o == nil {
+			return nil // the error is the same for every copy
+		}
+		objects = append(objects, o)
+	}
+	return objects
+}
+
+// generated builds the copy of g's object moved by d. It returns nil if the
+// object can't be built.
+func (b *groupBuilder) generated(path jsonPath, g *Generator, mat string, d Vec3) Object {
+	switch {
+	case g.RPrism != nil:
+		c := *g.RPrism
+		if c.Transform == nil {
+			c.Pos = c.Pos.Add(d)
+		} else {
+			c.Transform = c.Transform.translated(d)
+		}
+		return b.object(path.key("rprism"), &c, &c.MatName, c.Transform, mat)
+	case g.Sphere != nil:
+		c := *g.Sphere
+		if c.Transform == nil {
+			c.Center = c.Center.Add(d)
+		} else {
+			c.Transform = c.Transform.translated(d)
+		}
+		return b.object(path.key("sphere"), &c, &c.MatName, c.Transform, mat)
+	case g.Instance != nil:
+		c := *g.Instance
+		if d != (Vec3{}) {
+			c.Transform = c.Transform.translated(d)
+		}
+		return b.instance(path.key("instance"), &c, mat)
+	}
+	return nil
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestGeneratorRepeat(t *testing.T) {
+	g := &Generator{Type: "repeat", Count: 3, Offset: Vec3{1, 0, 2}}
+	got, err := g.offsets(AABB{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Vec3{{0, 0, 0}, {1, 0, 2}, {2, 0, 4}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got offsets %v; want %v", got, want)
+	}
+}
+
+func TestGeneratorGrid(t *testing.T) {
+	g := &Generator{Type: "grid", NX: 2, NY: 1, NZ: 3, Spacing: Vec3{1, 5, 2}}
+	got, err := g.offsets(AABB{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Vec3{
+		{0, 0, 0}, {0, 0, 2}, {0, 0, 4},
+		{1, 0, 0}, {1, 0, 2}, {1, 0, 4},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got offsets %v; want %v", got, want)
+	}
+}
+
+func TestGeneratorScatter(t *testing.T) {
+	// A unit box around the origin, scattered in a 10x1x10 region.
+	bounds := AABB{Vec3{-0.5, 0, -0.5}, Vec3{0.5, 1, 0.5}}
+	g := &Generator{
+		Type:      "scatter",
+		Count:     20,
+		Seed:      1,
+		Min:       Vec3{0, 0, 0},
+		Max:       Vec3{10, 1, 10},
+		NoOverlap: true,
+	}
+	offsets, err := g.offsets(bounds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(offsets) != g.Count {
+		t.Fatalf("got %d offsets; want %d", len(offsets), g.Count)
+	}
+	for i, d := range offsets {
+		min, max := bounds.Min.Add(d), bounds.Max.Add(d)
+		if min.X < g.Min.X || min.Y < g.Min.Y || min.Z < g.Min.Z ||
+			max.X > g.Max.X || max.Y > g.Max.Y || max.Z > g.Max.Z {
+			t.Errorf("copy %d spans %v to %v, outside the region", i, min, max)
+		}
+		if overlapsAny(d, offsets[:i], Vec3{1, 1, 1}) {
+			t.Errorf("copy %d at %v overlaps an earlier copy", i, d)
+		}
+	}
+
+	again, err := g.offsets(bounds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(again, offsets) {
+		t.Error("the same seed gave different offsets")
+	}
+	g.Seed = 2
+	other, err := g.offsets(bounds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reflect.DeepEqual(other, offsets) {
+		t.Error("different seeds gave the same offsets")
+	}
+}
+
+func TestGeneratorScatterErrors(t *testing.T) {
+	bounds := AABB{Vec3{-0.5, 0, -0.5}, Vec3{0.5, 1, 0.5}}
+	for _, tt := range []struct {
+		name string
+		g    *Generator
+		want string
+	}{
+		{
+			name: "object too big",
+			g:    &Generator{Type: "scatter", Count: 1, Max: Vec3{10, 0.5, 10}},
+			want: "object of size {1 1 1} doesn't fit in the scatter region",
+		},
+		{
+			// The offsets can only vary by 1 along X and Z, leaving no
+			// room for a second unit box.
+			name: "no room",
+			g:    &Generator{Type: "scatter", Count: 5, Max: Vec3{2, 1, 2}, NoOverlap: true},
+			want: "could only fit 1 of 5 copies without overlap",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := tt.g.offsets(bounds)
+			if err == nil || err.Error() != tt.want {
+				t.Errorf("got error %v; want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestGeneratorValidate(t *testing.T) {
+	sphere := &Sphere{Radius: 1}
+	for _, tt := range []struct {
+		name string
+		g    *Generator
+		want string // the error message, or "" for none
+	}{
+		{
+			name: "repeat",
+			g:    &Generator{Type: "repeat", Sphere: sphere, Count: 10},
+		},
+		{
+			name: "too many repeats",
+			g:    &Generator{Type: "repeat", Sphere: sphere, Count: maxCopies + 1},
+			want: "repeat count must be between 1 and 1048576; got 1048577",
+		},
+		{
+			name: "too many scattered",
+			g:    &Generator{Type: "scatter", Sphere: sphere, Count: 1 << 30},
+			want: "scatter count must be between 1 and 1048576; got 1073741824",
+		},
+		{
+			name: "grid",
+			g:    &Generator{Type: "grid", Sphere: sphere, NX: 1024, NY: 1024, NZ: 1},
+		},
+		{
+			name: "grid too big",
+			g:    &Generator{Type: "grid", Sphere: sphere, NX: 1024, NY: 1024, NZ: 2},
+			want: "grid of 1024 by 1024 by 2 has more than 1048576 copies",
+		},
+		{
+			// The product overflows int64.
+			name: "grid far too big",
+			g:    &Generator{Type: "grid", Sphere: sphere, NX: 1 << 40, NY: 1 << 40, NZ: 1 << 40},
+			want: "grid of 1099511627776 by 1099511627776 by 1099511627776 has more than 1048576 copies",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.g.validate()
+			var got string
+			if err != nil {
+				got = err.Error()
+			}
+			if got != tt.want {
+				t.Errorf("got error %q; want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// A Group is a collection of objects and nested groups that is placed in the
+// scene as a unit. Members that don't name a material use the group's
+// material (or that of the nearest enclosing group or instance that has one).
+// Only top-level objects act as area lights, so members can't be emissive.
+type Group struct {
+	MatName   string `json:"mat"`
+	Transform *Transform
+
+	Primitives
+	Groups    []*Group    // Nested groups
+	Instances []*Instance // Instances of named groups
+}
+
+// An Instance places a copy of a named group (from Scene.Groups) in the
+// scene. Instances of a group with the same default material share its
+// objects and its BVH.
+type Instance struct {
+	Group     string
+	MatName   string `json:"mat"`
+	Transform *Transform
+}
+
+// groupBuilder builds the groups of a scene. Objects that fail to build are
+// left out and their errors are reported to errs.
+type groupBuilder struct {
+	materials map[string]*Material
+	defs      map[string]*Group
+	errs      *errorList
+	built     map[groupKey]Object // named groups, in group space
+	building  map[string]bool     // to detect groups that contain themselves
+}
+
+func newGroupBuilder(materials map[string]*Material, defs map[string]*Group, errs *errorList) *groupBuilder {
+	return &groupBuilder{
+		materials: materials,
+		defs:      defs,
+		errs:      errs,
+		built:     make(map[groupKey]Object),
+		building:  make(map[string]bool),
+	}
+}
+
+// A groupKey identifies a named group built with a default material.
+type groupKey struct {
+	name, mat string
+}
+
+// build builds the objects in g, found at path in the scene, into a single
+// object, placed by g's Transform. mat is the default material from the
+// enclosing groups. It returns nil if g's transform is invalid.
+func (b *groupBuilder) build(path jsonPath, g *Group, mat string) Object {
+	if g.MatName != "" {
+		mat = g.MatName
+	}
+	objects := b.primitives(path, &g.Primitives, mat)
+	for i, sub := range g.Groups {
+		if o := b.build(path.key("groups").index(i), sub, mat); o != nil {
+			objects = append(objects, o)
+		}
+	}
+	for i, inst := range g.Instances {
+		if o := b.instance(path.key("instances").index(i), inst, mat); o != nil {
+			objects = append(objects, o)
+		}
+	}
+	for _, o := range objects {
+		if newAreaLight(o) != nil {
+			b.errs.report(path, errors.New("emissive objects can't be in groups; only top-level objects are area lights"))
+			return nil
+		}
+	}
+	var o Object = newBVH(objects)
+	if g.Transform != nil {
+		var err error
+		if o, err = newTransformed(o, g.Transform); err != nil {
+			b.errs.report(path.key("transform"), err)
+			return nil
+		}
+	}
+	return o
+}
+
+// primitives initializes the objects in p, found at path in the scene, where
+// mat is the default material.
+func (b *groupBuilder) primitives(path jsonPath, p *Primitives, mat string) []Object {
+	var objects []Object
+	// Objects are copied because a named group may be built more than once
+	// with different default materials.
+	add := func(path jsonPath, o Object, matName *string, t *Transform) {
+		if o := b.object(path, o, matName, t, mat); o != nil {
+			objects = append(objects, o)
+		}
+	}
+	for i, x := range p.RPrisms {
+		c := *x
+		add(path.key("rprisms").index(i), &c, &c.MatName, c.Transform)
+	}
+	for i, x := range p.Spheres {
+		c := *x
+		add(path.key("spheres").index(i), &c, &c.MatName, c.Transform)
+	}
+	for i, x := range p.Cylinders {
+		c := *x
+		add(path.key("cylinders").index(i), &c, &c.MatName, c.Transform)
+	}
+	for i, x := range p.Cones {
+		c := *x
+		add(path.key("cones").index(i), &c, &c.MatName, c.Transform)
+	}
+	for i, x := range p.Disks {
+		c := *x
+		add(path.key("disks").index(i), &c, &c.MatName, c.Transform)
+	}
+	for i, x := range p.Tori {
+		c := *x
+		add(path.key("tori").index(i), &c, &c.MatName, c.Transform)
+	}
+	for i, x := range p.SDFs {
+		c := *x
+		add(path.key("sdfs").index(i), &c, &c.MatName, c.Transform)
+	}
+	for i, x := range p.Heightfields {
+		c := *x
+		add(path.key("heightfields").index(i), &c, &c.MatName, c.Transform)
+	}
+	for i, x := range p.Quads {
+		c := *x
+		add(path.key("quads").index(i), &c, &c.MatName, c.Transform)
+	}
+	for i, x := range p.Planes {
+		c := *x
+		add(path.key("planes").index(i), &c, &c.MatName, c.Transform)
+	}
+	for i, c := range p.CSG {
+		o, err := buildCSG(c, mat, b.materials)
+		if err != nil {
+			b.errs.report(path.key("csg").index(i), err)
+			continue
+		}
+		objects = append(objects, o)
+	}
+	for i, g := range p.Generators {
+		objects = append(objects, b.generate(path.key("generators").index(i), g, mat)...)
+	}
+	return objects
+}
+
+// object initializes o, found at path in the scene, filling in its material
+// name with the default mat if it has none and wrapping it with the
+// transform t. It returns nil if o can't be initialized.
+func (b *groupBuilder) object(path jsonPath, o Object, matName *string, t *Transform, mat string) Object {
+	if *matName == "" {
+		*matName = mat
+	}
+	o, err := initObject(o, t, b.materials)
+	if err != nil {
+		b.errs.report(path, err)
+		return nil
+	}
+	return o
+}
+
+// instance returns the object for inst, found at path in the scene, where
+// mat is the default material from the enclosing groups. Each named group is
+// built only once for each default material. It returns nil if inst can't be
+// built.
+func (b *groupBuilder) instance(path jsonPath, inst *Instance, mat string) Object {
+	if inst.MatName != "" {
+		mat = inst.MatName
+	}
+	key := groupKey{inst.Group, mat}
+	o, ok := b.built[key]
+	if !ok {
+		g, ok := b.defs[inst.Group]
+		if !ok {
+			b.errs.report(path, fmt.Errorf("cannot find group %s", inst.Group))
+			return nil
+		}
+		if b.building[inst.Group] {
+			b.errs.report(path, fmt.Errorf("group %s contains an instance of itself", inst.Group))
+			return nil
+		}
+		b.building[inst.Group] = true
+		o = b.build(jsonPath{"groups", inst.Group}, g, mat)
+		delete(b.building, inst.Group)
+		if o == nil {
+			return nil
+		}
+		b.built[key] = o
+	}
+	if inst.Transform == nil {
+		return o
+	}
+	o, err := newTransformed(o, inst.Transform)
+	if err != nil {
+		b.errs.report(path.key("transform"), err)
+		return nil
+	}
+	return o
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// LoadHDRImage loads a high dynamic range image from a Radiance .hdr (RGBE)
+// or a .pfm (portable float map) file.
+func LoadHDRImage(name string) (*Image, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	var img *Image
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".hdr":
+		img, err = readRGBE(r)
+	case ".pfm":
+		img, err = readPFM(r)
+	default:
+		return nil, fmt.Errorf("%s: unknown HDR image format (want .hdr or .pfm)", name)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", name, err)
+	}
+	return img, nil
+}
+
+// The largest width or height and number of pixels accepted for an HDR
+// image. Larger sizes are most likely corrupt headers.
+const maxHDRSize, maxHDRPixels = 1 << 15, 1 << 28
+
+func checkHDRSize(width, height int) error {
+	if width < 1 || height < 1 || width > maxHDRSize || height > maxHDRSize || width*height > maxHDRPixels {
+		return fmt.Errorf("bad image size %dx%d", width, height)
+	}
+	return nil
+}
+
+// readRGBE reads a Radiance picture. Only the standard -Y h +X w orientation is
+// supported.
+func readRGBE(r *bufio.Reader) (*Image, error) {
+	var width, height int
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, errors.New("truncated header")
+		}
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "FORMAT=") && line != "FORMAT=32-bit_rle_rgbe" {
+			return nil, fmt.Errorf("unsupported format %q", line)
+		}
+		if strings.HasPrefix(line, "-Y ") {
+			if _, err := fmt.Sscanf(line, "-Y %d +X %d", &height, &width); err != nil {
+				return nil, fmt.Errorf("unsupported resolution line %q", line)
+			}
+			break
+		}
+	}
+	if err := checkHDRSize(width, height); err != nil {
+		return nil, err
+	}
+	img := NewImage(width, height)
+	scan := make([]byte, 4*width)
+	for y := 0; y < height; y++ {
+		if err := readRGBEScanline(r, scan, width); err != nil {
+			return nil, err
+		}
+		for x := 0; x < width; x++ {
+			img.Set(x, y, rgbe(scan[4*x:4*x+4]))
+		}
+	}
+	return img, nil
+}
+
+// readRGBEScanline reads one scanline of width pixels into scan, handling
+// both flat and (new-style) run-length encoded scanlines.
+func readRGBEScanline(r *bufio.Reader, scan []byte, width int) error {
+	head := make([]byte, 4)
+	if _, err := io.ReadFull(r, head); err != nil {
+		return err
+	}
+	if width < 8 || width > 0x7fff || head[0] != 2 || head[1] != 2 || head[2]&0x80 != 0 {
+		// Flat scanline.
+		copy(scan, head)
+		_, err := io.ReadFull(r, scan[4:])
+		return err
+	}
+	if int(head[2])<<8|int(head[3]) != width {
+		return errors.New("bad scanline width")
+	}
+	// Each of the four channels is run-length encoded separately.
+	for c := 0; c < 4; c++ {
+		for x := 0; x < width; {
+			n, err := r.ReadByte()
+			if err != nil {
+				return err
+			}
+			if n > 128 {
+				n -= 128
+				v, err := r.ReadByte()
+				if err != nil {
+					return err
+				}
+				if x+int(n) > width {
+					return errors.New("bad scanline data")
+				}
+				for i := 0; i < int(n); i++ {
+					scan[4*x+c] = v
+					x++
+				}
+				continue
+			}
+			if n == 0 || x+int(n) > width {
+				return errors.New("bad scanline data")
+			}
+			for i := 0; i < int(n); i++ {
+				v, err := r.ReadByte()
+				if err != nil {
+					return err
+				}
+				scan[4*x+c] = v
+				x++
+			}
+		}
+	}
+	return nil
+}
+
+func rgbe(b []byte) Color {
+	if b[3] == 0 {
+		return Black
+	}
+	f := math.Ldexp(1, int(b[3])-(128+8))
+	return Color{float64(b[0]) * f, float64(b[1]) * f, float64(b[2]) * f}
+}
+
+// readPFM reads a portable float map ("PF" for color or "Pf" for grayscale).
+func readPFM(r *bufio.Reader) (*Image, error) {
+	var (
+		magic         string
+		width, height int
+		scale         float64
+	)
+	if _, err := fmt.Fscan(r, &magic, &width, &height, &scale); err != nil {
+		return nil, fmt.Errorf("bad header: %s", err)
+	}
+	// A single whitespace character separates the header from the data.
+	if _, err := r.ReadByte(); err != nil {
+		return nil, err
+	}
+	var channels int
+	switch magic {
+	case "PF":
+		channels = 3
+	case "Pf":
+		channels = 1
+	default:
+		return nil, fmt.Errorf("bad magic number %q", magic)
+	}
+	if err := checkHDRSize(width, height); err != nil {
+		return nil, err
+	}
+	var order binary.ByteOrder = binary.BigEndian
+	if scale < 0 {
+		order = binary.LittleEndian
+	}
+	data := make([]byte, 4*channels*width*height)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+	br := bytes.NewReader(data)
+	vals := make([]float32, channels)
+	img := NewImage(width, height)
+	// Rows are stored from bottom to top.
+	for y := height - 1; y >= 0; y-- {
+		for x := 0; x < width; x++ {
+			if err := binary.Read(br, order, vals); err != nil {
+				return nil, err
+			}
+			c := Color{float64(vals[0]), float64(vals[0]), float64(vals[0])}
+			if channels == 3 {
+				c.G, c.B = float64(vals[1]), float64(vals[2])
+			}
+			img.Set(x, y, c)
+		}
+	}
+	return img, nil
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/png"
+	"math"
+	"os"
+)
+
+// A Heightfield is terrain whose height is given by a grayscale PNG (8 or 16
+// bits per sample). The image lies in the XZ plane with its top-left pixel
+// at Pos and its rows running toward +Z; black is at height Pos.Y and white
+// is Height above that. Each square of four neighboring pixels is split into
+// two triangles.
+type Heightfield struct {
+	File      string
+	Pos       Vec3
+	Extent    [2]float64 // Size in X and Z
+	Height    float64
+	MatName   string `json:"mat"`
+	Transform *Transform
+
+	mat          *Material
+	nx, nz       int       // samples in X and Z
+	heights      []float64 // world Y of each sample, by row
+	normals      []Vec3    // at each sample, for shading
+	cellX, cellZ float64
+	minH, maxH   float64
+}
+
+func (hf *Heightfield) Initialize(materials map[string]*Material) error {
+	m, err := findMaterial(materials, hf.MatName)
+	if err != nil {
+		return err
+	}
+	hf.mat = m
+	f, err := os.Open(hf.File)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	img, _, err := image.Decode(f)
+	if err != nil {
+		return fmt.Errorf("cannot decode %s: %s", hf.File, err)
+	}
+	b := img.Bounds()
+	hf.nx, hf.nz = b.Dx(), b.Dy()
+	if hf.nx < 2 || hf.nz < 2 {
+		return fmt.Errorf("heightfield %s must be at least 2x2", hf.File)
+	}
+	hf.cellX = hf.Extent[0] / float64(hf.nx-1)
+	hf.cellZ = hf.Extent[1] / float64(hf.nz-1)
+	hf.heights = make([]float64, hf.nx*hf.nz)
+	hf.minH, hf.maxH = math.Inf(1), math.Inf(-1)
+	for z := 0; z < hf.nz; z++ {
+		for x := 0; x < hf.nx; x++ {
+			g := color.Gray16Model.Convert(img.At(b.Min.X+x, b.Min.Y+z)).(color.Gray16)
+			h := hf.Pos.Y + hf.Height*float64(g.Y)/0xFFFF
+			hf.heights[z*hf.nx+x] = h
+			hf.minH = math.Min(hf.minH, h)
+			hf.maxH = math.Max(hf.maxH, h)
+		}
+	}
+	hf.normals = make([]Vec3, len(hf.heights))
+	for z := 0; z < hf.nz; z++ {
+		for x := 0; x < hf.nx; x++ {
+			// Central differences (one-sided at the edges).
+			x0, x1 := maxInt(x-1, 0), minInt(x+1, hf.nx-1)
+			z0, z1 := maxInt(z-1, 0), minInt(z+1, hf.nz-1)
+			dx := (hf.height(x1, z) - hf.height(x0, z)) / (float64(x1-x0) * hf.cellX)
+			dz := (hf.height(x, z1) - hf.height(x, z0)) / (float64(z1-z0) * hf.cellZ)
+			hf.normals[z*hf.nx+x] = Vec3{-dx, 1, -dz}.Normalize()
+		}
+	}
+	return nil
+}
+
+func (hf *Heightfield) validate() error {
+	if hf.Extent[0] <= 0 || hf.Extent[1] <= 0 {
+		return fmt.Errorf("extent must be positive; got %v", hf.Extent)
+	}
+	return nil
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func (hf *Heightfield) height(x, z int) float64 { return hf.heights[z*hf.nx+x] }
+
+func (hf *Heightfield) vertex(x, z int) Vec3 {
+	return Vec3{hf.Pos.X + float64(x)*hf.cellX, hf.height(x, z), hf.Pos.Z + float64(z)*hf.cellZ}
+}
+
+func (hf *Heightfield) Bounds() AABB {
+	return AABB{
+		Vec3{hf.Pos.X, hf.minH, hf.Pos.Z},
+		Vec3{hf.Pos.X + hf.Extent[0], hf.maxH, hf.Pos.Z + hf.Extent[1]},
+	}
+}
+
+// A heightfieldHit is an intersection with one of a heightfield's triangles.
+type heightfieldHit struct {
+	t       float64
+	x, z    int     // the cell
+	upper   bool    // which triangle of the cell
+	b1, b2  float64 // barycentric coordinates of the hit
+	geomNrm Vec3
+}
+
+// nearest walks the cells under r in order (a 2D DDA, as in Amanatides and
+// Woo's voxel traversal), skipping cells whose range of heights the ray
+// misses, and tests the triangles of the rest.
+func (hf *Heightfield) nearest(r Ray, maxD float64) (heightfieldHit, bool) {
+	tEnter, tEnd, ok := hf.Bounds().clip(r, minDistance, maxD)
+	if !ok {
+		return heightfieldHit{}, false
+	}
+	// Grid coordinates of the ray, in cells.
+	gx := func(t float64) float64 { return (r.V.X + t*r.D.X - hf.Pos.X) / hf.cellX }
+	gz := func(t float64) float64 { return (r.V.Z + t*r.D.Z - hf.Pos.Z) / hf.cellZ }
+	x := minInt(maxInt(int(math.Floor(gx(tEnter))), 0), hf.nx-2)
+	z := minInt(maxInt(int(math.Floor(gz(tEnter))), 0), hf.nz-2)
+	dgx, dgz := r.D.X/hf.cellX, r.D.Z/hf.cellZ
+	stepX, tNextX, tDeltaX := ddaAxis(gx(0), dgx, x)
+	stepZ, tNextZ, tDeltaZ := ddaAxis(gz(0), dgz, z)
+	for tEnter <= tEnd {
+		tExit := math.Min(math.Min(tNextX, tNextZ), tEnd)
+		// Skip the cell if the ray is entirely above or below it.
+		y0, y1 := r.V.Y+tEnter*r.D.Y, r.V.Y+tExit*r.D.Y
+		h00, h10, h01, h11 := hf.height(x, z), hf.height(x+1, z), hf.height(x, z+1), hf.height(x+1, z+1)
+		cellMin := math.Min(math.Min(h00, h10), math.Min(h01, h11))
+		cellMax := math.Max(math.Max(h00, h10), math.Max(h01, h11))
+		if math.Max(y0, y1) >= cellMin && math.Min(y0, y1) <= cellMax {
+			if h, ok := hf.intersectCell(r, x, z, maxD); ok {
+				return h, true
+			}
+		}
+		if tNextX < tNextZ {
+			x += stepX
+			tEnter = tNextX
+			tNextX += tDeltaX
+		} else {
+			z += stepZ
+			tEnter = tNextZ
+			tNextZ += tDeltaZ
+		}
+		if x < 0 || x > hf.nx-2 || z < 0 || z > hf.nz-2 {
+			break
+		}
+	}
+	return heightfieldHit{}, false
+}
+
+// ddaAxis sets up traversal along one grid axis for a ray starting at grid
+// coordinate g moving d cells per unit of t, currently in cell i. It returns
+// the step direction, the t at which the ray crosses into the next cell, and
+// the t between crossings.
+func ddaAxis(g, d float64, i int) (step int, tNext, tDelta float64) {
+	switch {
+	case d > 0:
+		return 1, (float64(i+1) - g) / d, 1 / d
+	case d < 0:
+		return -1, (float64(i) - g) / d, -1 / d
+	}
+	return 0, math.Inf(1), math.Inf(1)
+}
+
+// intersectCell finds the nearer intersection of r with the two triangles of
+// cell (x, z).
+func (hf *Heightfield) intersectCell(r Ray, x, z int, maxD float64) (heightfieldHit, bool) {
+	p00, p10, p01, p11 := hf.vertex(x, z), hf.vertex(x+1, z), hf.vertex(x, z+1), hf.vertex(x+1, z+1)
+	best := heightfieldHit{t: maxD}
+	found := false
+	for _, tri := range [2]struct {
+		a, b, c Vec3
+		upper   bool
+	}{{p00, p10, p01, false}, {p10, p11, p01, true}} {
+		t, b1, b2, ok := intersectTriangle(r, tri.a, tri.b, tri.c)
+		if !ok || t <= minDistance || t >= best.t {
+			continue
+		}
+		n := tri.c.Sub(tri.a).Cross(tri.b.Sub(tri.a)).Normalize() // points up
+		best = heightfieldHit{t: t, x: x, z: z, upper: tri.upper, b1: b1, b2: b2, geomNrm: n}
+		found = true
+	}
+	return best, found
+}
+
+// intersectTriangle is the Möller-Trumbore ray-triangle intersection. It
+// returns the ray parameter and the barycentric coordinates of the hit
+// relative to b and c.
+func intersectTriangle(r Ray, a, b, c Vec3) (t, b1, b2 float64, ok bool) {
+	e1, e2 := b.Sub(a), c.Sub(a)
+	pv := r.D.Cross(e2)
+	det := e1.Dot(pv)
+	if det == 0 {
+		return 0, 0, 0, false
+	}
+	inv := 1 / det
+	tv := r.V.Sub(a)
+	b1 = tv.Dot(pv) * inv
+	if b1 < 0 || b1 > 1 {
+		return 0, 0, 0, false
+	}
+	qv := tv.Cross(e1)
+	b2 = r.D.Dot(qv) * inv
+	if b2 < 0 || b1+b2 > 1 {
+		return 0, 0, 0, false
+	}
+	return e2.Dot(qv) * inv, b1, b2, true
+}
+
+func (hf *Heightfield) Intersect(r Ray, h *Hit) bool {
+	hh, ok := hf.nearest(r, h.D)
+	if !ok {
+		return false
+	}
+	x, z := hh.x, hh.z
+	// Interpolate the vertex normals for shading.
+	var na, nb, nc Vec3
+	if hh.upper {
+		na, nb, nc = hf.normals[z*hf.nx+x+1], hf.normals[(z+1)*hf.nx+x+1], hf.normals[(z+1)*hf.nx+x]
+	} else {
+		na, nb, nc = hf.normals[z*hf.nx+x], hf.normals[z*hf.nx+x+1], hf.normals[(z+1)*hf.nx+x]
+	}
+	h.D = hh.t
+	h.P = r.At(hh.t)
+	h.setNormal(hh.geomNrm, r.D)
+	h.Shading = na.Mul(1 - hh.b1 - hh.b2).Add(nb.Mul(hh.b1)).Add(nc.Mul(hh.b2)).Normalize()
+	h.UV = UV{
+		U:     (h.P.X - hf.Pos.X) / hf.Extent[0],
+		V:     (h.P.Z - hf.Pos.Z) / hf.Extent[1],
+		Scale: 1 / math.Min(hf.Extent[0], hf.Extent[1]),
+	}
+	h.Mat = hf.mat
+	return true
+}
+
+func (hf *Heightfield) Occluded(r Ray, maxD float64) bool {
+	_, ok := hf.nearest(r, maxD)
+	return ok
+}
@@ -0,0 +1,36 @@
+package main
+
+// A Hit records where a ray intersects an object.
+type Hit struct {
+	D      float64 // Distance along the ray, in units of the ray's D
+	P      Vec3    // Point of intersection
+	Normal Vec3    // Geometric unit normal (outward for closed objects)
+	// Shading is the unit normal to use for shading. It is the same as
+	// Normal unless the object interpolates or perturbs its normals.
+	Shading   Vec3
+	UV        UV
+	Mat       *Material
+	Object    int  // Index of the object in the scene (set by the scene)
+	FrontFace bool // Whether the ray arrived from the side Normal faces
+}
+
+// newHit returns a Hit that any intersection is closer than.
+func newHit() Hit {
+	return Hit{D: maxDistance}
+}
+
+// setNormal sets both of h's normals to the unit vector n and sets
+// h.FrontFace for a ray in direction d.
+func (h *Hit) setNormal(n, d Vec3) {
+	h.Normal = n
+	h.Shading = n
+	h.FrontFace = d.Dot(n) < 0
+}
+
+// flip turns h's normals around, as when the inside of a solid becomes the
+// outside of another.
+func (h *Hit) flip() {
+	h.Normal = h.Normal.Mul(-1)
+	h.Shading = h.Shading.Mul(-1)
+	h.FrontFace = !h.FrontFace
+}
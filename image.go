@@ -77,3 +77,13 @@ func (i *Image) ToneMap() *image.RGBA {
 	}
 	return img
 }
+
+// Gray converts i to a grayscale image by clamping the luminance of each
+// pixel to [0, 1]. Unlike ToneMap, it does not rescale the values.
+func (i *Image) Gray() *image.Gray {
+	img := image.NewGray(image.Rect(0, 0, i.Width, i.Height))
+	for j, c := range i.Pix {
+		img.Pix[j] = uint8(clamp(c.Luminance()) * 0xFF)
+	}
+	return img
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	_ "image/jpeg"
+	_ "image/png"
+	"math"
+	"os"
+)
+
+// An imageTexture maps a bitmap onto a surface using UV coordinates. It keeps
+// a mipmap (a pyramid of successively half-sized copies) and blends between
+// the two levels that best match the size of a pixel's footprint, using
+// bilinear filtering within each level. The footprint comes from the ray
+// differentials followed from the camera (see rayDifferential). Filtering is
+// isotropic, so surfaces seen at grazing angles are blurred along their
+// length as well as across it.
+type imageTexture struct {
+	levels []*Image // levels[0] is the full-size image
+	wrap   func(float64) float64
+	scale  float64
+}
+
+func newImageTexture(t *TextureSpec) (*imageTexture, error) {
+	f, err := os.Open(t.File)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	src, _, err := image.Decode(f)
+	if err != nil {
+		return nil, fmt.Errorf("cannot decode %s: %s", t.File, err)
+	}
+	tex := &imageTexture{scale: t.Scale}
+	if tex.scale == 0 {
+		tex.scale = 1
+	}
+	switch t.Wrap {
+	case "", "repeat":
+		tex.wrap = func(x float64) float64 { return x - math.Floor(x) }
+	case "clamp":
+		tex.wrap = clamp
+	case "mirror":
+		tex.wrap = func(x float64) float64 {
+			x = math.Mod(math.Abs(x), 2)
+			if x > 1 {
+				x = 2 - x
+			}
+			return x
+		}
+	default:
+		return nil, fmt.Errorf("unknown wrap mode %q", t.Wrap)
+	}
+
+	b := src.Bounds()
+	img := NewImage(b.Dx(), b.Dy())
+	for y := 0; y < img.Height; y++ {
+		for x := 0; x < img.Width; x++ {
+			r, g, bl, _ := src.At(b.Min.X+x, b.Min.Y+y).RGBA()
+			img.Set(x, y, Color{float64(r) / 0xFFFF, float64(g) / 0xFFFF, float64(bl) / 0xFFFF})
+		}
+	}
+	tex.levels = []*Image{img}
+	for img.Width > 1 || img.Height > 1 {
+		img = halve(img)
+		tex.levels = append(tex.levels, img)
+	}
+	return tex, nil
+}
+
+// halve downsamples img by averaging 2x2 blocks (odd edges are clamped).
+func halve(img *Image) *Image {
+	w, h := (img.Width+1)/2, (img.Height+1)/2
+	half := NewImage(w, h)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			x0, y0 := 2*x, 2*y
+			x1, y1 := x0+1, y0+1
+			if x1 >= img.Width {
+				x1 = x0
+			}
+			if y1 >= img.Height {
+				y1 = y0
+			}
+			c := img.At(x0, y0).Add(img.At(x1, y0)).Add(img.At(x0, y1)).Add(img.At(x1, y1))
+			half.Set(x, y, c.MulS(0.25))
+		}
+	}
+	return half
+}
+
+func (t *imageTexture) At(tp TexPoint) Color {
+	u := tp.UV.U / t.scale
+	v := tp.UV.V / t.scale
+	// The footprint of the pixel, in texels of the full-size image, picks
+	// the mip level.
+	texels := tp.Width * tp.UV.Scale / t.scale * float64(t.levels[0].Width)
+	level := 0.0
+	if texels > 1 {
+		level = math.Min(math.Log2(texels), float64(len(t.levels)-1))
+	}
+	l0 := int(level)
+	c := t.bilinear(t.levels[l0], u, v)
+	if frac := level - float64(l0); frac > 0 && l0+1 < len(t.levels) {
+		c = c.MulS(1 - frac).Add(t.bilinear(t.levels[l0+1], u, v).MulS(frac))
+	}
+	return c
+}
+
+// bilinear samples img at (u, v). V increases from the bottom of the image to
+// the top.
+func (t *imageTexture) bilinear(img *Image, u, v float64) Color {
+	x := t.wrap(u)*float64(img.Width) - 0.5
+	y := (1-t.wrap(v))*float64(img.Height) - 0.5
+	x0, y0 := math.Floor(x), math.Floor(y)
+	fx, fy := x-x0, y-y0
+	texel := func(x, y int) Color {
+		// Neighbors of edge texels follow the wrap mode too.
+		x = int(t.wrap((float64(x)+0.5)/float64(img.Width)) * float64(img.Width))
+		y = int(t.wrap((float64(y)+0.5)/float64(img.Height)) * float64(img.Height))
+		if x >= img.Width {
+			x = img.Width - 1
+		}
+		if y >= img.Height {
+			y = img.Height - 1
+		}
+		return img.At(x, y)
+	}
+	ix, iy := int(x0), int(y0)
+	top := texel(ix, iy).MulS(1 - fx).Add(texel(ix+1, iy).MulS(fx))
+	bottom := texel(ix, iy+1).MulS(1 - fx).Add(texel(ix+1, iy+1).MulS(fx))
+	return top.MulS(1 - fy).Add(bottom.MulS(fy))
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+)
+
+// LoadScene reads the scene in the named JSON file along with the files it
+// includes.
+//
+// Each file named in a scene's Include list (relative to the including file)
+// is a scene fragment whose materials, textures, groups, lights, and objects
+// are merged into the including scene. The rules for names that collide are:
+//
+//   - A file's own definitions (of a material, texture, or group, or of a
+//     setting like the camera or ambient light) override those of the files
+//     it includes. This way a scene can customize a shared library.
+//   - Two included files may not define the same thing.
+//
+// Lists (of lights, objects, and instances) are concatenated. A file that is
+// included more than once is only merged the first time. A file can't
+// include itself, directly or indirectly.
+//
+// The image, environment map, and heightfield files that a scene file names
+// are also relative to that file.
+func LoadScene(name string) (*Scene, error) {
+	l := &sceneLoader{loaded: make(map[string]bool)}
+	return l.load(name)
+}
+
+// A sceneLoader loads a scene file and the files it includes.
+type sceneLoader struct {
+	loaded map[string]bool // by absolute path
+	stack  []string        // the chain of includes being loaded
+}
+
+func (l *sceneLoader) load(name string) (*Scene, error) {
+	abs, err := filepath.Abs(name)
+	if err != nil {
+		return nil, err
+	}
+	for i, s := range l.stack {
+		if s == abs {
+			chain := append(append([]string(nil), l.stack[i:]...), abs)
+			return nil, fmt.Errorf("include cycle: %s", strings.Join(chain, " -> "))
+		}
+	}
+	l.loaded[abs] = true
+	l.stack = append(l.stack, abs)
+	defer func() { l.stack = l.stack[:len(l.stack)-1] }()
+
+	raw, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	filterJSONComments(raw)
+	s := &Scene{}
+	x, err := expandExprs(raw, reflect.TypeOf(s))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", name, jsonError(raw, err))
+	}
+	if err := decodeStrict(x.raw, s); err != nil {
+		return nil, fmt.Errorf("%s: %s", name, jsonError(raw, x.origError(err)))
+	}
+	s.resolveFiles(filepath.Dir(name))
+	s.sources = newSourceMap(s, &sourceFile{name, raw})
+	for _, inc := range s.Include {
+		incName := inc
+		if !filepath.IsAbs(incName) {
+			incName = filepath.Join(filepath.Dir(name), incName)
+		}
+		incAbs, err := filepath.Abs(incName)
+		if err != nil {
+			return nil, err
+		}
+		if l.loaded[incAbs] && !l.onStack(incAbs) {
+			continue
+		}
+		is, err := l.load(incName)
+		if err != nil {
+			return nil, err
+		}
+		if err := s.merge(is); err != nil {
+			return nil, fmt.Errorf("%s: including %s: %s", name, inc, err)
+		}
+	}
+	return s, nil
+}
+
+// resolveFiles makes the relative names of the image, environment map, and
+// heightfield files in s relative to dir, the directory of the scene file.
+func (s *Scene) resolveFiles(dir string) {
+	resolve := func(name *string) {
+		if *name != "" && !filepath.IsAbs(*name) {
+			*name = filepath.Join(dir, *name)
+		}
+	}
+	for _, t := range s.Textures {
+		resolve(&t.File)
+	}
+	if s.Environment != nil {
+		resolve(&s.Environment.File)
+	}
+	var group func(p *Primitives, groups []*Group)
+	group = func(p *Primitives, groups []*Group) {
+		for _, hf := range p.Heightfields {
+			resolve(&hf.File)
+		}
+		for _, g := range groups {
+			group(&g.Primitives, g.Groups)
+		}
+	}
+	group(&s.Primitives, nil)
+	for _, g := range s.Groups {
+		group(&g.Primitives, g.Groups)
+	}
+}
+
+func (l *sceneLoader) onStack(abs string) bool {
+	for _, s := range l.stack {
+		if s == abs {
+			return true
+		}
+	}
+	return false
+}
+
+// A sourceFile is a scene file.
+type sourceFile struct {
+	name string
+	raw  []byte // with comments blanked out
+}
+
+// A sourceSpan says that the elements [start, start+n) of a list in a
+// merged scene are elements [0, n) of the same list in file.
+type sourceSpan struct {
+	start, n int
+	file     *sourceFile
+}
+
+// A sourceMap records which file each part of a merged scene came from, so
+// that errors can point into the right file. Parts of the scene are named by
+// their keys in the scene's JSON.
+type sourceMap struct {
+	main   *sourceFile                       // the file that included the others
+	lists  map[string][]sourceSpan           // for lists, like "rprisms"
+	names  map[string]map[string]*sourceFile // for named things, like "materials"
+	fields map[string]*sourceFile            // for settings, like "camera"
+}
+
+// The keys of the parts of a scene that are maps of named things.
+var namedKeys = []string{"materials", "textures", "groups"}
+
+func newSourceMap(s *Scene, f *sourceFile) *sourceMap {
+	m := &sourceMap{
+		main:   f,
+		lists:  make(map[string][]sourceSpan),
+		names:  make(map[string]map[string]*sourceFile),
+		fields: make(map[string]*sourceFile),
+	}
+	for key, v := range s.lists() {
+		if n := v.Len(); n > 0 {
+			m.lists[key] = []sourceSpan{{0, n, f}}
+		}
+	}
+	for key, v := range s.namedMaps() {
+		m.names[key] = make(map[string]*sourceFile)
+		for _, k := range v.MapKeys() {
+			m.names[key][k.String()] = f
+		}
+	}
+	// A setting counts as set if the file has its key, even if the value
+	// is a zero value like "#000".
+	for key := range s.settings() {
+		if _, ok := jsonOffset(f.raw, jsonPath{key}); ok {
+			m.fields[key] = f
+		}
+	}
+	return m
+}
+
+// locate finds the file containing the part of the scene at path, along
+// with its path within that file.
+func (m *sourceMap) locate(path jsonPath) (*sourceFile, jsonPath) {
+	if m == nil || len(path) == 0 {
+		return nil, nil
+	}
+	key, _ := path[0].(string)
+	key = strings.ToLower(key)
+	if len(path) > 1 {
+		switch e := path[1].(type) {
+		case int:
+			for _, sp := range m.lists[key] {
+				if e >= sp.start && e < sp.start+sp.n {
+					local := append(jsonPath{path[0], e - sp.start}, path[2:]...)
+					return sp.file, local
+				}
+			}
+			return nil, nil
+		case string:
+			if f, ok := m.names[key][e]; ok {
+				return f, path
+			}
+		}
+	}
+	if f, ok := m.fields[key]; ok {
+		return f, path
+	}
+	return m.main, path
+}
+
+// lists returns the lists in s that are concatenated when scenes are merged,
+// by JSON key.
+func (s *Scene) lists() map[string]reflect.Value {
+	ls := map[string]reflect.Value{
+		"plights":   reflect.ValueOf(&s.PLights).Elem(),
+		"instances": reflect.ValueOf(&s.Instances).Elem(),
+	}
+	p := reflect.ValueOf(&s.Primitives).Elem()
+	for i := 0; i < p.NumField(); i++ {
+		ls[strings.ToLower(p.Type().Field(i).Name)] = p.Field(i)
+	}
+	return ls
+}
+
+func (s *Scene) namedMaps() map[string]reflect.Value {
+	return map[string]reflect.Value{
+		"materials": reflect.ValueOf(&s.Materials).Elem(),
+		"textures":  reflect.ValueOf(&s.Textures).Elem(),
+		"groups":    reflect.ValueOf(&s.Groups).Elem(),
+	}
+}
+
+// settings returns the parts of s of which a scene has only one.
+func (s *Scene) settings() map[string]reflect.Value {
+	return map[string]reflect.Value{
+		"camera":      reflect.ValueOf(&s.Camera).Elem(),
+		"ambient":     reflect.ValueOf(&s.Ambient).Elem(),
+		"ao":          reflect.ValueOf(&s.AO).Elem(),
+		"environment": reflect.ValueOf(&s.Environment).Elem(),
+		"photons":     reflect.ValueOf(&s.Photons).Elem(),
+	}
+}
+
+// merge merges the scene inc, which s includes, into s.
+func (s *Scene) merge(inc *Scene) error {
+	src, isrc := s.sources, inc.sources
+	own := func(f *sourceFile) bool { return f == src.main }
+
+	incSettings := inc.settings()
+	for key, v := range s.settings() {
+		incFile, ok := isrc.fields[key]
+		if !ok {
+			continue
+		}
+		f, ok := src.fields[key]
+		if !ok {
+			v.Set(incSettings[key])
+			src.fields[key] = incFile
+			continue
+		}
+		if !own(f) {
+			return fmt.Errorf("%s is set in both %s and %s", key, f.name, incFile.name)
+		}
+	}
+
+	incMaps := inc.namedMaps()
+	for _, key := range namedKeys {
+		v, iv := s.namedMaps()[key], incMaps[key]
+		if iv.Len() == 0 {
+			continue
+		}
+		if v.IsNil() {
+			v.Set(reflect.MakeMap(v.Type()))
+		}
+		for _, k := range iv.MapKeys() {
+			name := k.String()
+			if v.MapIndex(k).IsValid() {
+				if f := src.names[key][name]; !own(f) {
+					return fmt.Errorf("%s %s is defined in both %s and %s",
+						strings.TrimSuffix(key, "s"), name, f.name, isrc.names[key][name].name)
+				}
+				continue
+			}
+			v.SetMapIndex(k, iv.MapIndex(k))
+			if src.names[key] == nil {
+				src.names[key] = make(map[string]*sourceFile)
+			}
+			src.names[key][name] = isrc.names[key][name]
+		}
+	}
+
+	incLists := inc.lists()
+	for key, v := range s.lists() {
+		iv := incLists[key]
+		offset := v.Len()
+		v.Set(reflect.AppendSlice(v, iv))
+		for _, sp := range isrc.lists[key] {
+			src.lists[key] = append(src.lists[key], sourceSpan{sp.start + offset, sp.n, sp.file})
+		}
+	}
+	return nil
+}
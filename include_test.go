@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+// writeScenes writes the named scene files to a new temporary directory and
+// returns the directory.
+func writeScenes(t *testing.T, files map[string]string) string {
+	dir := t.TempDir()
+	for name, text := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(text), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestIncludeCycle(t *testing.T) {
+	dir := writeScenes(t, map[string]string{
+		"a.json": `{"include": ["b.json"]}`,
+		"b.json": `{"include": ["a.json"]}`,
+	})
+	a, b := filepath.Join(dir, "a.json"), filepath.Join(dir, "b.json")
+	_, err := LoadScene(a)
+	want := "include cycle: " + a + " -> " + b + " -> " + a
+	if err == nil || err.Error() != want {
+		t.Fatalf("got error %v; want %q", err, want)
+	}
+}
+
+func TestIncludeCollision(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		lib1     string
+		lib2     string
+		wantTail string
+	}{
+		{
+			name:     "material",
+			lib1:     `{"materials": {"red": {"color": "#F00"}}}`,
+			lib2:     `{"materials": {"red": {"color": "#E00"}}}`,
+			wantTail: "material red is defined in both %s and %s",
+		},
+		{
+			// Both files set the ambient light, even though one sets it
+			// to the zero value.
+			name:     "setting",
+			lib1:     `{"ambient": "#000"}`,
+			lib2:     `{"ambient": "#FFF"}`,
+			wantTail: "ambient is set in both %s and %s",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := writeScenes(t, map[string]string{
+				"main.json": `{"include": ["lib1.json", "lib2.json"]}`,
+				"lib1.json": tt.lib1,
+				"lib2.json": tt.lib2,
+			})
+			main := filepath.Join(dir, "main.json")
+			lib1, lib2 := filepath.Join(dir, "lib1.json"), filepath.Join(dir, "lib2.json")
+			_, err := LoadScene(main)
+			want := main + ": including lib2.json: " + fmt.Sprintf(tt.wantTail, lib1, lib2)
+			if err == nil || err.Error() != want {
+				t.Fatalf("got error %v; want %q", err, want)
+			}
+		})
+	}
+}
+
+func TestIncludeOverride(t *testing.T) {
+	dir := writeScenes(t, map[string]string{
+		"main.json": `{
+			"include": ["lib.json"],
+			"ambient": "#000",
+			"materials": {"red": {"color": "#E22"}}
+		}`,
+		"lib.json": `{
+			"ambient": "#FFF",
+			"photons": {"count": 10, "radius": 1},
+			"materials": {"red": {"color": "#F00"}, "blue": {"color": "#00F"}}
+		}`,
+	})
+	s, err := LoadScene(filepath.Join(dir, "main.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The including file's settings and definitions win, even zero ones;
+	// the rest come from the library.
+	if s.Ambient != Black {
+		t.Errorf("got ambient %v; want %v", s.Ambient, Black)
+	}
+	if s.Photons == nil || s.Photons.Count != 10 {
+		t.Errorf("got photons %+v; want the library's", s.Photons)
+	}
+	for name, hex := range map[string]string{"red": "#E22", "blue": "#00F"} {
+		want, _ := ParseHexColor(hex)
+		if m, ok := s.Materials[name]; !ok || m.Color != want {
+			t.Errorf("got material %s %+v; want color %s", name, m, hex)
+		}
+	}
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+)
+
+// An Integrator computes the light arriving at the camera along a ray.
+type Integrator interface {
+	Li(r Ray, rng *rand.Rand) Color
+}
+
+// NewIntegrator constructs the named integrator: "whitted" for classic
+// shading with Scene.Trace, or "path" for the Monte Carlo path tracer.
+func NewIntegrator(name string, scene *Scene, maxDepth int) (Integrator, error) {
+	switch name {
+	case "whitted":
+		return WhittedIntegrator{scene}, nil
+	case "path":
+		return &PathTracer{Scene: scene, MaxDepth: maxDepth}, nil
+	}
+	return nil, fmt.Errorf("unknown integrator %q", name)
+}
+
+// A WhittedIntegrator shades rays with Scene.Trace: direct light from point
+// lights plus a constant (optionally occluded) ambient term.
+type WhittedIntegrator struct {
+	*Scene
+}
+
+func (w WhittedIntegrator) Li(r Ray, rng *rand.Rand) Color {
+	return w.Trace(r, rng)
+}
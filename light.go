@@ -1,16 +1,138 @@
 package main
 
+import (
+	"math"
+	"math/rand"
+)
+
+// A Light is a light source that the path tracer samples for direct
+// illumination (next-event estimation).
+type Light interface {
+	// SampleLi picks a direction from p toward the light. It returns the unit
+	// direction wi, the distance to the sampled point on the light (which may
+	// be infinite), the radiance arriving at p from that direction, and the
+	// probability density (with respect to solid angle) of having chosen wi.
+	// For delta lights, li is the irradiance and pdf is 1.
+	SampleLi(p Vec3, rng *rand.Rand) (wi Vec3, d float64, li Color, pdf float64)
+	// PdfLi is the density with which SampleLi would choose wi from p.
+	PdfLi(p, wi Vec3) float64
+	// Delta reports whether the light is a delta distribution (such as a
+	// point light) that can only be reached by sampling it directly.
+	Delta() bool
+}
+
 // A PLight is a point light source.
 type PLight struct {
 	Pos   Vec3
 	Color Color
 }
 
-// An InfLight is a light at infinity.
-//type InfLight struct {
-//Dir Vec3
-//Color Color
-//}
+func (l *PLight) SampleLi(p Vec3, rng *rand.Rand) (Vec3, float64, Color, float64) {
+	wi := l.Pos.Sub(p)
+	d := wi.Mag()
+	// Point lights fall off according to the inverse square law.
+	return wi.Div(d), d, l.Color.MulS(1 / (d * d)), 1
+}
+
+func (l *PLight) PdfLi(p, wi Vec3) float64 { return 0 }
+
+func (l *PLight) Delta() bool { return true }
+
+// ambientLight treats the scene's ambient color as uniform illumination
+// arriving from every direction. Rays that escape the scene see it.
+type ambientLight struct {
+	c Color
+}
+
+func (l ambientLight) SampleLi(p Vec3, rng *rand.Rand) (Vec3, float64, Color, float64) {
+	return uniformSphere(rng.Float64(), rng.Float64()), math.Inf(1), l.c, 1 / (4 * math.Pi)
+}
+
+func (l ambientLight) PdfLi(p, wi Vec3) float64 { return 1 / (4 * math.Pi) }
+
+func (l ambientLight) Delta() bool { return false }
+
+// Le is the radiance carried by a ray that escapes the scene in direction d.
+func (l ambientLight) Le(d Vec3) Color { return l.c }
+
+// A Surface is an object whose surface can be sampled uniformly by area. An
+// emissive Surface acts as an area light.
+type Surface interface {
+	Area() float64
+	// SampleSurface returns a point chosen uniformly on the surface along
+	// with the outward unit normal at that point.
+	SampleSurface(rng *rand.Rand) (p, normal Vec3)
+	Material() *Material
+}
+
+// An areaLight is an emissive object. It emits its material's emitted
+// radiance from the outside of its surface.
+type areaLight struct {
+	obj  Object
+	surf Surface
+	le   Color
+}
+
+// newAreaLight returns an areaLight for o if it is an emissive Surface and
+// nil otherwise.
+func newAreaLight(o Object) *areaLight {
+	surf, ok := o.(Surface)
+	if !ok {
+		return nil
+	}
+	le := surf.Material().emitted()
+	if le == Black || surf.Area() == 0 {
+		return nil
+	}
+	return &areaLight{obj: o, surf: surf, le: le}
+}
+
+func (l *areaLight) SampleLi(p Vec3, rng *rand.Rand) (Vec3, float64, Color, float64) {
+	q, n := l.surf.SampleSurface(rng)
+	wi := q.Sub(p)
+	d := wi.Mag()
+	wi = wi.Div(d)
+	pdf := l.pdf(d, wi, n)
+	if pdf == 0 {
+		return wi, d, Black, 0
+	}
+	return wi, d, l.le, pdf
+}
+
+func (l *areaLight) PdfLi(p, wi Vec3) float64 {
+	h := newHit()
+	if !l.obj.Intersect(Ray{p, wi}, &h) {
+		return 0
+	}
+	return l.pdf(h.D*wi.Mag(), wi.Normalize(), h.Normal)
+}
+
+// pdf converts the area density of a point on the light at distance d in the
+// unit direction wi, with unit normal n, to a density over solid angle.
+func (l *areaLight) pdf(d float64, wi, n Vec3) float64 {
+	cos := -wi.Dot(n)
+	if cos <= 0 {
+		// The back of the surface doesn't emit.
+		return 0
+	}
+	return d * d / (cos * l.surf.Area())
+}
+
+func (l *areaLight) Delta() bool { return false }
+
+// A DLight is a directional light: a light at infinity, such as the sun.
+// Color is the irradiance it delivers to a surface facing it.
+type DLight struct {
+	Dir   Vec3 // Direction the light travels
+	Color Color
+}
+
+func (l *DLight) SampleLi(p Vec3, rng *rand.Rand) (Vec3, float64, Color, float64) {
+	return l.Dir.Normalize().Mul(-1), math.Inf(1), l.Color, 1
+}
+
+func (l *DLight) PdfLi(p, wi Vec3) float64 { return 0 }
+
+func (l *DLight) Delta() bool { return true }
 
 // TODO: Spotlight
-// TODO: Area light
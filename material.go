@@ -1,5 +1,10 @@
 package main
 
+import (
+	"errors"
+	"fmt"
+)
+
 type Material struct {
 	// Object Color
 	Color    Color // Ambient/Diffuse color
@@ -10,4 +15,171 @@ type Material struct {
 	Kd    float64 // Diffuse/Lambertian reflection
 	Ks    float64 // Specular reflection
 	Alpha float64 // Exponent for specular highlight (shininess constant)
+
+	// Perfect specular parameters
+	Kr  float64 // Mirror reflection
+	Kt  float64 // Transmission (refraction)
+	IOR float64 // Index of refraction for transmission (0 means 1)
+
+	// Emission makes objects with this material glow. Emissive objects are
+	// visible directly and (except for infinite planes) light the scene.
+	Emission         Color
+	EmissionStrength float64 // Scale for Emission (0 means 1)
+
+	// Textures (by name) that replace Color and Specular and scale Kd (by
+	// their luminance) at each point
+	ColorTex    string
+	SpecularTex string
+	KdTex       string
+
+	colorTex, specularTex, kdTex Texture
+}
+
+func (m *Material) Initialize(textures map[string]Texture) error {
+	for _, t := range []struct {
+		name string
+		tex  *Texture
+	}{
+		{m.ColorTex, &m.colorTex},
+		{m.SpecularTex, &m.specularTex},
+		{m.KdTex, &m.kdTex},
+	} {
+		if t.name == "" {
+			continue
+		}
+		tex, ok := textures[t.name]
+		if !ok {
+			return fmt.Errorf("cannot find texture %s", t.name)
+		}
+		*t.tex = tex
+	}
+	return nil
+}
+
+// findMaterial looks up the material called name. If there is none, the
+// error suggests the most similar name, to help with typos.
+func findMaterial(materials map[string]*Material, name string) (*Material, error) {
+	if m, ok := materials[name]; ok {
+		return m, nil
+	}
+	if name == "" {
+		return nil, errors.New("no material given")
+	}
+	best, bestDist := "", 0
+	for _, other := range sortedKeys(materials) {
+		d := levenshtein(name, other)
+		if best == "" || d < bestDist {
+			best, bestDist = other, d
+		}
+	}
+	// Only suggest names that are plausibly typos.
+	if best != "" && bestDist <= maxInt(2, len(name)/3) {
+		return nil, fmt.Errorf("cannot find material %s (did you mean %s?)", name, best)
+	}
+	return nil, fmt.Errorf("cannot find material %s", name)
+}
+
+// levenshtein returns the edit distance between a and b: the number of
+// single-character insertions, deletions, and substitutions that turn one
+// into the other.
+func levenshtein(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	cur := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		cur[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			cur[j] = minInt(minInt(prev[j]+1, cur[j-1]+1), prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(rb)]
+}
+
+// ColorAt returns the (ambient/diffuse) color of m at tp.
+func (m *Material) ColorAt(tp TexPoint) Color {
+	if m.colorTex != nil {
+		return m.colorTex.At(tp)
+	}
+	return m.Color
+}
+
+// SpecularAt returns the specular color of m at tp.
+func (m *Material) SpecularAt(tp TexPoint) Color {
+	if m.specularTex != nil {
+		return m.specularTex.At(tp)
+	}
+	return m.Specular
+}
+
+// KdAt returns the diffuse coefficient of m at tp.
+func (m *Material) KdAt(tp TexPoint) float64 {
+	if m.kdTex != nil {
+		return m.Kd * m.kdTex.At(tp).Luminance()
+	}
+	return m.Kd
+}
+
+// emitted returns the radiance emitted by a surface made of m.
+func (m *Material) emitted() Color {
+	if m.EmissionStrength == 0 {
+		return m.Emission
+	}
+	return m.Emission.MulS(m.EmissionStrength)
+}
+
+// specular reports whether m has any perfect specular component.
+func (m *Material) specular() bool {
+	return m.Kr > 0 || m.Kt > 0
+}
+
+// refract computes the direction of a transmitted ray for a ray in direction
+// d hitting m at a surface with normal n. The normal should point out of the
+// object, so that a ray with d·n < 0 is entering it. ok is false in the case
+// of total internal reflection.
+func (m *Material) refract(d, n Vec3) (t Vec3, ok bool) {
+	ior := m.IOR
+	if ior == 0 {
+		ior = 1
+	}
+	d = d.Normalize()
+	eta := 1 / ior
+	if d.Dot(n) > 0 {
+		// Leaving the object.
+		n = n.Mul(-1)
+		eta = ior
+	}
+	return d.Refract(n, eta)
+}
+
+// scatterSpecular picks a perfect specular event for a ray in direction d
+// hitting m at a surface with outward normal n, using the uniform sample u:
+// mirror reflection with probability Kr, transmission with probability Kt
+// (which falls back to reflection on total internal reflection), and
+// otherwise none, in which case ok is false.
+func (m *Material) scatterSpecular(d, n Vec3, u float64) (dir Vec3, ok bool) {
+	if u >= m.Kr+m.Kt {
+		return Vec3{}, false
+	}
+	if u >= m.Kr {
+		if t, ok := m.refract(d, n); ok {
+			return t, true
+		}
+	}
+	return d.Normalize().Reflect(faceForward(n, d)), true
+}
+
+// faceForward returns n or -n, whichever points against d.
+func faceForward(n, d Vec3) Vec3 {
+	if n.Dot(d) > 0 {
+		return n.Mul(-1)
+	}
+	return n
 }
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"errors"
+	"math"
+)
+
+// A Matrix4 is a 4x4 matrix for affine transformations of homogeneous
+// coordinates, stored in row-major order. Points are column vectors, so
+// m.Mul(n) applies n first and then m.
+type Matrix4 [4][4]float64
+
+func Identity() Matrix4 {
+	return Matrix4{
+		{1, 0, 0, 0},
+		{0, 1, 0, 0},
+		{0, 0, 1, 0},
+		{0, 0, 0, 1},
+	}
+}
+
+func Translation(v Vec3) Matrix4 {
+	m := Identity()
+	m[0][3], m[1][3], m[2][3] = v.X, v.Y, v.Z
+	return m
+}
+
+func Scaling(v Vec3) Matrix4 {
+	m := Identity()
+	m[0][0], m[1][1], m[2][2] = v.X, v.Y, v.Z
+	return m
+}
+
+// RotationX, RotationY, and RotationZ rotate counterclockwise (looking down
+// the axis toward the origin) by an angle in radians.
+func RotationX(a float64) Matrix4 {
+	s, c := math.Sincos(a)
+	m := Identity()
+	m[1][1], m[1][2] = c, -s
+	m[2][1], m[2][2] = s, c
+	return m
+}
+
+func RotationY(a float64) Matrix4 {
+	s, c := math.Sincos(a)
+	m := Identity()
+	m[0][0], m[0][2] = c, s
+	m[2][0], m[2][2] = -s, c
+	return m
+}
+
+func RotationZ(a float64) Matrix4 {
+	s, c := math.Sincos(a)
+	m := Identity()
+	m[0][0], m[0][1] = c, -s
+	m[1][0], m[1][1] = s, c
+	return m
+}
+
+func (m Matrix4) Mul(n Matrix4) Matrix4 {
+	var p Matrix4
+	for i := 0; i < 4; i++ {
+		for j := 0; j < 4; j++ {
+			for k := 0; k < 4; k++ {
+				p[i][j] += m[i][k] * n[k][j]
+			}
+		}
+	}
+	return p
+}
+
+func (m Matrix4) Transpose() Matrix4 {
+	var t Matrix4
+	for i := 0; i < 4; i++ {
+		for j := 0; j < 4; j++ {
+			t[i][j] = m[j][i]
+		}
+	}
+	return t
+}
+
+var errSingular = errors.New("matrix is not invertible")
+
+// Inverse computes the inverse of m by Gauss-Jordan elimination with partial
+// pivoting.
+func (m Matrix4) Inverse() (Matrix4, error) {
+	inv := Identity()
+	for col := 0; col < 4; col++ {
+		pivot := col
+		for row := col + 1; row < 4; row++ {
+			if math.Abs(m[row][col]) > math.Abs(m[pivot][col]) {
+				pivot = row
+			}
+		}
+		if math.Abs(m[pivot][col]) < 1e-12 {
+			return Matrix4{}, errSingular
+		}
+		m[col], m[pivot] = m[pivot], m[col]
+		inv[col], inv[pivot] = inv[pivot], inv[col]
+		f := 1 / m[col][col]
+		for j := 0; j < 4; j++ {
+			m[col][j] *= f
+			inv[col][j] *= f
+		}
+		for row := 0; row < 4; row++ {
+			if row == col {
+				continue
+			}
+			f := m[row][col]
+			for j := 0; j < 4; j++ {
+				m[row][j] -= f * m[col][j]
+				inv[row][j] -= f * inv[col][j]
+			}
+		}
+	}
+	return inv, nil
+}
+
+// MulPoint transforms the point v (with homogeneous coordinate 1).
+func (m Matrix4) MulPoint(v Vec3) Vec3 {
+	return Vec3{
+		m[0][0]*v.X + m[0][1]*v.Y + m[0][2]*v.Z + m[0][3],
+		m[1][0]*v.X + m[1][1]*v.Y + m[1][2]*v.Z + m[1][3],
+		m[2][0]*v.X + m[2][1]*v.Y + m[2][2]*v.Z + m[2][3],
+	}
+}
+
+// MulDir transforms the direction v (with homogeneous coordinate 0), which
+// ignores translation.
+func (m Matrix4) MulDir(v Vec3) Vec3 {
+	return Vec3{
+		m[0][0]*v.X + m[0][1]*v.Y + m[0][2]*v.Z,
+		m[1][0]*v.X + m[1][1]*v.Y + m[1][2]*v.Z,
+		m[2][0]*v.X + m[2][1]*v.Y + m[2][2]*v.Z,
+	}
+}
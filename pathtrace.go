@@ -0,0 +1,147 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+)
+
+// A PathTracer is a Monte Carlo path tracing integrator. At each diffuse or
+// glossy hit it estimates direct light by sampling one light (next-event
+// estimation), then continues the path in a direction sampled from the BSDF.
+// Light that can be reached by both strategies is combined with multiple
+// importance sampling. Perfect specular reflection and transmission are
+// followed as they are chosen. Paths end after MaxDepth bounces or, past the
+// first few bounces, by Russian roulette.
+//
+// Unlike Scene.Trace, the path tracer does not add a constant ambient term;
+// instead Scene.Ambient is the radiance of rays that escape the scene.
+type PathTracer struct {
+	*Scene
+	MaxDepth int
+}
+
+// An infiniteLight is a Light that surrounds the scene and is seen by rays
+// that hit nothing.
+type infiniteLight interface {
+	Light
+	Le(d Vec3) Color
+}
+
+// Paths shorter than this are never terminated by Russian roulette.
+const rouletteDepth = 3
+
+func (pt *PathTracer) Li(r Ray, rng *rand.Rand) Color {
+	l := Black
+	beta := Color{1, 1, 1} // path throughput
+	bsdfPdf := 0.0         // pdf of the BSDF sample that produced r (0 for camera rays and specular bounces)
+	rd := &pt.cameraDiff   // differential of r (nil once unknown)
+	for depth := 0; ; depth++ {
+		h, ok := pt.intersect(r)
+		if !ok {
+			l = l.Add(beta.Mul(pt.escaped(r.D.Normalize(), bsdfPdf)))
+			break
+		}
+		mat, p := h.Mat, h.P
+		if le := mat.emitted(); le != Black {
+			if light, ok := pt.emitters[h.Object]; ok && bsdfPdf > 0 {
+				// This light could also have been reached by next-event
+				// estimation at the previous vertex.
+				pick := 1 / float64(len(pt.lights))
+				lightPdf := light.pdf(h.D*r.D.Mag(), r.D.Normalize(), h.Normal)
+				le = le.MulS(powerHeuristic(bsdfPdf, pick*lightPdf))
+			}
+			l = l.Add(beta.Mul(le))
+		}
+		if depth >= pt.MaxDepth {
+			break
+		}
+		rd = rd.at(r, h.D, h.Normal)
+		if mat.specular() {
+			// Perfect specular events are chosen with probability equal to
+			// their weight; otherwise the rest of the material is sampled.
+			u := rng.Float64()
+			if dir, ok := mat.scatterSpecular(r.D, h.Normal, u); ok {
+				rd = rd.scatter(r.D, func(v Vec3) Vec3 {
+					dir, _ := mat.scatterSpecular(v, h.Normal, u)
+					return dir
+				})
+				r = Ray{p, dir}
+				bsdfPdf = 0
+				continue
+			}
+			beta = beta.MulS(1 / (1 - mat.Kr - mat.Kt))
+		}
+		wo := r.D.Normalize().Mul(-1)
+		n := faceForward(h.Shading, r.D)
+		bsdf := newPhongBSDF(mat, texPoint(p, h.UV, rd))
+
+		l = l.Add(beta.Mul(pt.sampleLight(p, wo, n, bsdf, rng)))
+
+		wi, f, pdf := bsdf.Sample(wo, n, rng)
+		if pdf == 0 {
+			break
+		}
+		beta = beta.Mul(f.MulS(wi.Dot(n) / pdf))
+		bsdfPdf = pdf
+		r = Ray{p, wi}
+		// Neighboring paths scatter in unrelated directions, so textures
+		// past a diffuse or glossy bounce aren't filtered.
+		rd = nil
+
+		if depth >= rouletteDepth {
+			q := math.Max(0.05, 1-beta.Max())
+			if rng.Float64() < q {
+				break
+			}
+			beta = beta.MulS(1 / (1 - q))
+		}
+	}
+	return l
+}
+
+// sampleLight estimates the light arriving at p directly from one randomly
+// chosen light and reflected toward wo.
+func (pt *PathTracer) sampleLight(p, wo, n Vec3, bsdf *phongBSDF, rng *rand.Rand) Color {
+	if len(pt.lights) == 0 {
+		return Black
+	}
+	light := pt.lights[rng.Intn(len(pt.lights))]
+	pick := 1 / float64(len(pt.lights))
+	wi, d, li, pdf := light.SampleLi(p, rng)
+	if pdf == 0 || li == Black {
+		return Black
+	}
+	cos := wi.Dot(n)
+	if cos <= 0 {
+		return Black
+	}
+	f := bsdf.F(wo, wi, n)
+	if f == Black || pt.occluded(p, wi, d) {
+		return Black
+	}
+	weight := 1.0
+	if !light.Delta() {
+		weight = powerHeuristic(pick*pdf, bsdf.Pdf(wo, wi, n))
+	}
+	return f.Mul(li).MulS(cos * weight / (pick * pdf))
+}
+
+// escaped returns the (MIS-weighted) radiance of a ray leaving the scene in
+// direction d. bsdfPdf is the density with which the BSDF chose d, or 0 if d
+// was not chosen by BSDF sampling.
+func (pt *PathTracer) escaped(d Vec3, bsdfPdf float64) Color {
+	l := Black
+	for _, light := range pt.lights {
+		inf, ok := light.(infiniteLight)
+		if !ok {
+			continue
+		}
+		le := inf.Le(d)
+		if bsdfPdf > 0 {
+			pick := 1 / float64(len(pt.lights))
+			le = le.MulS(powerHeuristic(bsdfPdf, pick*inf.PdfLi(Vec3{}, d)))
+		}
+		l = l.Add(le)
+	}
+	return l
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+)
+
+// PhotonSettings configures the caustic photon map.
+type PhotonSettings struct {
+	Count    int     // Number of photons to emit (across all lights)
+	Radius   float64 // Gather radius for radiance estimates
+	MaxDepth int     // Maximum number of bounces per photon (0 means 8)
+}
+
+// A photon is a packet of light stored where it landed on a diffuse surface.
+type photon struct {
+	p     Vec3
+	dir   Vec3 // incoming direction (pointing toward the surface)
+	power Color
+	axis  int // splitting axis in the kd-tree
+}
+
+// A photonMap is a kd-tree of photons. It is stored implicitly: the root of
+// the subtree for any range of the slice is the middle element of the range.
+type photonMap struct {
+	photons []photon
+}
+
+// BuildPhotonMap runs the photon mapping pre-pass. Photons are emitted from
+// the point lights and emissive objects in proportion to their power and
+// followed through perfect specular bounces; those that land on a diffuse
+// surface after at least one specular bounce are stored in the caustic photon
+// map.
+func (s *Scene) BuildPhotonMap(rng *rand.Rand) {
+	if s.Photons == nil {
+		return
+	}
+	maxDepth := s.Photons.MaxDepth
+	if maxDepth == 0 {
+		maxDepth = 8
+	}
+	var sources []photonSource
+	for _, l := range s.PLights {
+		sources = append(sources, l)
+	}
+	for _, l := range s.areaLights {
+		sources = append(sources, l)
+	}
+	var total float64
+	for _, src := range sources {
+		total += src.power().Luminance()
+	}
+	if total == 0 {
+		return // there's no light to make caustics
+	}
+	var photons []photon
+	for _, src := range sources {
+		power := src.power()
+		n := int(float64(s.Photons.Count) * power.Luminance() / total)
+		if n == 0 {
+			continue
+		}
+		power = power.MulS(1 / float64(n))
+		for i := 0; i < n; i++ {
+			photons = s.tracePhoton(photons, src.emit(rng), power, maxDepth, rng)
+		}
+	}
+	s.photons = &photonMap{photons}
+	s.photons.build(0, len(photons))
+}
+
+// A photonSource is a light that can emit photons.
+type photonSource interface {
+	// power is the total power emitted by the light.
+	power() Color
+	// emit chooses the origin and direction of a photon, distributed
+	// according to the light's emission.
+	emit(rng *rand.Rand) Ray
+}
+
+// A point light's intensity (Color) integrated over the sphere.
+func (l *PLight) power() Color { return l.Color.MulS(4 * math.Pi) }
+
+func (l *PLight) emit(rng *rand.Rand) Ray {
+	return Ray{l.Pos, uniformSphere(rng.Float64(), rng.Float64())}
+}
+
+// An area light's (Lambertian) radiance integrated over the hemisphere and
+// its surface.
+func (l *areaLight) power() Color { return l.le.MulS(math.Pi * l.surf.Area()) }
+
+func (l *areaLight) emit(rng *rand.Rand) Ray {
+	p, n := l.surf.SampleSurface(rng)
+	return Ray{p, cosineHemisphere(rng.Float64(), rng.Float64()).FromLocal(n)}
+}
+
+func (s *Scene) tracePhoton(photons []photon, r Ray, power Color, maxDepth int, rng *rand.Rand) []photon {
+	for depth := 0; depth < maxDepth; depth++ {
+		h, ok := s.intersect(r)
+		if !ok {
+			break
+		}
+		dir, ok := h.Mat.scatterSpecular(r.D, h.Normal, rng.Float64())
+		if !ok {
+			if depth > 0 {
+				photons = append(photons, photon{p: h.P, dir: r.D.Normalize(), power: power})
+			}
+			break
+		}
+		r = Ray{h.P, dir}
+	}
+	return photons
+}
+
+// build arranges m.photons[lo:hi] into a kd-tree.
+func (m *photonMap) build(lo, hi int) {
+	if hi-lo <= 1 {
+		return
+	}
+	// Split along the axis of greatest extent.
+	min := Vec3{math.Inf(1), math.Inf(1), math.Inf(1)}
+	max := Vec3{math.Inf(-1), math.Inf(-1), math.Inf(-1)}
+	for _, ph := range m.photons[lo:hi] {
+		min = Vec3{math.Min(min.X, ph.p.X), math.Min(min.Y, ph.p.Y), math.Min(min.Z, ph.p.Z)}
+		max = Vec3{math.Max(max.X, ph.p.X), math.Max(max.Y, ph.p.Y), math.Max(max.Z, ph.p.Z)}
+	}
+	ext := max.Sub(min)
+	axis := 0
+	if ext.Y > ext.X {
+		axis = 1
+	}
+	if ext.Z > axisValue(ext, axis) {
+		axis = 2
+	}
+	sub := m.photons[lo:hi]
+	sort.Slice(sub, func(i, j int) bool {
+		return axisValue(sub[i].p, axis) < axisValue(sub[j].p, axis)
+	})
+	mid := (lo + hi) / 2
+	m.photons[mid].axis = axis
+	m.build(lo, mid)
+	m.build(mid+1, hi)
+}
+
+func axisValue(v Vec3, axis int) float64 {
+	switch axis {
+	case 0:
+		return v.X
+	case 1:
+		return v.Y
+	}
+	return v.Z
+}
+
+// gather calls fn for every photon within distance r of p.
+func (m *photonMap) gather(p Vec3, r float64, fn func(ph *photon, d2 float64)) {
+	m.gatherRange(0, len(m.photons), p, r*r, fn)
+}
+
+func (m *photonMap) gatherRange(lo, hi int, p Vec3, r2 float64, fn func(*photon, float64)) {
+	if lo >= hi {
+		return
+	}
+	mid := (lo + hi) / 2
+	ph := &m.photons[mid]
+	if d2 := p.Sub(ph.p).Dot(p.Sub(ph.p)); d2 <= r2 {
+		fn(ph, d2)
+	}
+	if hi-lo == 1 {
+		return
+	}
+	delta := axisValue(p, ph.axis) - axisValue(ph.p, ph.axis)
+	near, far := [2]int{lo, mid}, [2]int{mid + 1, hi}
+	if delta > 0 {
+		near, far = far, near
+	}
+	m.gatherRange(near[0], near[1], p, r2, fn)
+	if delta*delta <= r2 {
+		m.gatherRange(far[0], far[1], p, r2, fn)
+	}
+}
+
+// irradiance estimates the irradiance at p (on a surface with unit normal n)
+// from the photons within radius r. Photons are weighted with a cone filter
+// to reduce blurring at the edges of caustics.
+func (m *photonMap) irradiance(p, n Vec3, r float64) Color {
+	e := Black
+	m.gather(p, r, func(ph *photon, d2 float64) {
+		if ph.dir.Dot(n) >= 0 {
+			// Arrived at the other side of the surface.
+			return
+		}
+		w := 1 - math.Sqrt(d2)/r
+		e = e.Add(ph.power.MulS(w))
+	})
+	// The cone filter integrates to (1/3)πr².
+	return e.MulS(3 / (math.Pi * r * r))
+}
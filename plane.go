@@ -2,6 +2,8 @@ package main
 
 import (
 	"fmt"
+	"math"
+	"math/rand"
 )
 
 type Plane struct {
@@ -15,52 +17,188 @@ type PlaneObject struct {
 
 	V1, V2, V3 Vec3
 	MatName    string `json:"mat"`
+	Transform  *Transform
+	// Extent limits the plane to the parallelogram with corners V1, V2, V3,
+	// and V2 + V3 - V1 ("parallelogram") or to the triangle V1, V2, V3
+	// ("triangle"). By default the plane is infinite.
+	Extent string
+
+	// Orthonormal axes in the plane for UV coordinates. U is along V2 - V1
+	// and the origin is at V1.
+	uAxis, vAxis Vec3
+	// The edges V2 - V1 and V3 - V1, and w, which gives the coordinates of a
+	// point relative to them (see coords).
+	e1, e2, w Vec3
+}
+
+// A Quad is a parallelogram with one corner at Corner and sides Edge1 and
+// Edge2. Its normal is Edge1 × Edge2.
+type Quad struct {
+	Corner       Vec3
+	Edge1, Edge2 Vec3
+	MatName      string `json:"mat"`
+	Transform    *Transform
+
+	PlaneObject `json:"-"`
+}
+
+func (q *Quad) Initialize(materials map[string]*Material) error {
+	q.PlaneObject = PlaneObject{
+		V1:      q.Corner,
+		V2:      q.Corner.Add(q.Edge1),
+		V3:      q.Corner.Add(q.Edge2),
+		MatName: q.MatName,
+		Extent:  "parallelogram",
+	}
+	return q.PlaneObject.Initialize(materials)
 }
 
 func (p *PlaneObject) Initialize(materials map[string]*Material) error {
-	m, ok := materials[p.MatName]
-	if !ok {
-		return fmt.Errorf("Cannot find material %s", p.MatName)
+	m, err := findMaterial(materials, p.MatName)
+	if err != nil {
+		return err
 	}
 	p.Mat = m
 	// Construct two vectors, v2v1 and v3v1; their cross product is normal
 	// to the plane.
 	l1 := p.V2.Sub(p.V1)
 	l2 := p.V3.Sub(p.V1)
+	n := l1.Cross(l2)
 	p.Plane = &Plane{
 		q:      p.V1,
-		normal: l1.Cross(l2),
+		normal: n.Normalize(),
+	}
+	p.e1, p.e2 = l1, l2
+	p.w = n.Div(n.Dot(n))
+	p.uAxis = l1.Normalize()
+	p.vAxis = p.normal.Cross(l1).Normalize()
+	return nil
+}
+
+func (p *PlaneObject) validate() error {
+	switch p.Extent {
+	case "", "parallelogram", "triangle":
+	default:
+		return fmt.Errorf("unknown extent %q", p.Extent)
+	}
+	n := p.V2.Sub(p.V1).Cross(p.V3.Sub(p.V1))
+	if n.Dot(n) == 0 {
+		return fmt.Errorf("points %v, %v, and %v are collinear", p.V1, p.V2, p.V3)
+	}
+	return nil
+}
+
+func (q *Quad) validate() error {
+	if n := q.Edge1.Cross(q.Edge2); n.Dot(n) == 0 {
+		return fmt.Errorf("edges %v and %v are parallel", q.Edge1, q.Edge2)
 	}
 	return nil
 }
 
-// Intersect determines the intersection of r with p.
+// intersectT determines the distance along r to its intersection with p.
 //
 // A point p is on the plane if normal·(p - q) = 0.
 // Points on the ray are of the form P(t) = ray.V + t*ray.D for t >= 0.
 // Thus intersections have the solution
-//           normal · (q - ray.V)
-//       t = ---------------------
-//             ray.D · normal
+//
+//	    normal · (q - ray.V)
+//	t = ---------------------
+//	      ray.D · normal
+//
 // If t < 0, then the intersection is behind the vantage point and doesn't count.
-func (p *PlaneObject) Intersect(r Ray) (float64, *Material, Vec3, Vec3, bool) {
+func (p *PlaneObject) intersectT(r Ray) (float64, bool) {
 	denom := r.D.Dot(p.normal)
 	if denom == 0 {
 		// Ray is parallel to the plane
-		return 0, nil, Vec3{}, Vec3{}, false
+		return 0, false
 	}
 	num := p.normal.Dot(p.q.Sub(r.V))
 	t := num / denom
 	if t < minDistance {
 		// Intersection is behind the vantage point.
-		return 0, nil, Vec3{}, Vec3{}, false
+		return 0, false
 	}
-	normal := p.normal
-	if denom > 0 {
-		// If the ray is less than 90 degrees from the normal line
-		// (dot product > 0), we're hitting the 'back' of the plane
-		// and we want to return the opposite normal.
-		normal = p.normal.Mul(-1)
+	if p.Extent != "" {
+		a, b := p.coords(r.At(t))
+		if a < 0 || b < 0 || a > 1 || b > 1 || (p.Extent == "triangle" && a+b > 1) {
+			return 0, false
+		}
+	}
+	return t, true
+}
+
+// coords returns the coordinates (a, b) of the point pt on the plane such that
+// pt = V1 + a*e1 + b*e2.
+func (p *PlaneObject) coords(pt Vec3) (a, b float64) {
+	rel := pt.Sub(p.V1)
+	return p.w.Dot(rel.Cross(p.e2)), p.w.Dot(p.e1.Cross(rel))
+}
+
+// Intersect determines the intersection of r with p. The normal follows the
+// winding of V1, V2, V3; rays hitting the other side have FrontFace false.
+//
+// The UV coordinates of infinite planes are planar: distances along the
+// plane's axes from V1. Finite planes use the coordinates along their edges,
+// from 0 to 1.
+func (p *PlaneObject) Intersect(r Ray, h *Hit) bool {
+	t, ok := p.intersectT(r)
+	if !ok || t >= h.D {
+		return false
+	}
+	pt := r.At(t)
+	rel := pt.Sub(p.V1)
+	h.D = t
+	h.P = pt
+	h.setNormal(p.normal, r.D)
+	if p.Extent == "" {
+		h.UV = UV{U: rel.Dot(p.uAxis), V: rel.Dot(p.vAxis), Scale: 1}
+	} else {
+		a, b := p.coords(pt)
+		h.UV = UV{U: a, V: b, Scale: 1 / math.Min(p.e1.Mag(), p.e2.Mag())}
+	}
+	h.Mat = p.Mat
+	return true
+}
+
+func (p *PlaneObject) Occluded(r Ray, maxD float64) bool {
+	t, ok := p.intersectT(r)
+	return ok && t < maxD
+}
+
+// Bounds is infinite unless the plane has an extent.
+func (p *PlaneObject) Bounds() AABB {
+	if p.Extent == "" {
+		return infiniteAABB
+	}
+	b := AABB{p.V1, p.V1}
+	corners := []Vec3{p.V2, p.V3}
+	if p.Extent == "parallelogram" {
+		corners = append(corners, p.V2.Add(p.e2))
+	}
+	for _, c := range corners {
+		b = b.Union(AABB{c, c})
+	}
+	return b
+}
+
+func (p *PlaneObject) Material() *Material { return p.Mat }
+
+// Area is 0 for infinite planes, so they are never area lights.
+func (p *PlaneObject) Area() float64 {
+	a := p.e1.Cross(p.e2).Mag()
+	switch p.Extent {
+	case "parallelogram":
+		return a
+	case "triangle":
+		return a / 2
+	}
+	return 0
+}
+
+func (p *PlaneObject) SampleSurface(rng *rand.Rand) (Vec3, Vec3) {
+	a, b := rng.Float64(), rng.Float64()
+	if p.Extent == "triangle" && a+b > 1 {
+		a, b = 1-a, 1-b
 	}
-	return t, p.Mat, r.At(t), normal, true
+	return p.V1.Add(p.e1.Mul(a)).Add(p.e2.Mul(b)), p.normal
 }
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"math"
+	"sort"
+)
+
+// solveQuadratic appends the real roots of a*x² + b*x + c to roots.
+func solveQuadratic(a, b, c float64, roots []float64) []float64 {
+	if a == 0 {
+		if b == 0 {
+			return roots
+		}
+		return append(roots, -c/b)
+	}
+	disc := b*b - 4*a*c
+	if disc < 0 {
+		return roots
+	}
+	// Avoid cancellation by computing the larger-magnitude root first.
+	q := -0.5 * (b + math.Copysign(math.Sqrt(disc), b))
+	if q == 0 {
+		return append(roots, 0, 0)
+	}
+	return append(roots, q/a, c/q)
+}
+
+// solveCubic appends the real roots of x³ + a*x² + b*x + c to roots.
+func solveCubic(a, b, c float64, roots []float64) []float64 {
+	// Substitute x = y - a/3 to get y³ + p*y + q = 0.
+	a3 := a / 3
+	p := b - a*a3
+	q := 2*a3*a3*a3 - a3*b + c
+	p3, q2 := p/3, q/2
+	disc := q2*q2 + p3*p3*p3
+	if disc >= 0 {
+		// One real root (Cardano).
+		s := math.Sqrt(disc)
+		return append(roots, math.Cbrt(-q2+s)+math.Cbrt(-q2-s)-a3)
+	}
+	// Three real roots (trigonometric method); p3 < 0 here.
+	r := math.Sqrt(-p3)
+	phi := math.Acos(math.Max(-1, math.Min(1, -q2/(r*r*r)))) / 3
+	for k := 0; k < 3; k++ {
+		roots = append(roots, 2*r*math.Cos(phi-2*math.Pi*float64(k)/3)-a3)
+	}
+	return roots
+}
+
+// solveQuartic appends the real roots of a*x⁴ + b*x³ + c*x² + d*x + e to
+// roots, in increasing order. It uses Ferrari's method and then polishes
+// each root with a few steps of Newton's method on the original polynomial,
+// which repairs most of the precision lost in the closed-form solution.
+func solveQuartic(a, b, c, d, e float64, roots []float64) []float64 {
+	if a == 0 {
+		return solveCubic3(b, c, d, e, roots)
+	}
+	n := len(roots)
+	// Make it monic: x⁴ + A*x³ + B*x² + C*x + D.
+	A, B, C, D := b/a, c/a, d/a, e/a
+	// Substitute x = y - A/4 to get y⁴ + p*y² + q*y + r = 0.
+	A4 := A / 4
+	AA := A * A
+	p := B - 3*AA/8
+	q := C - A*B/2 + AA*A/8
+	r := D - A*C/4 + AA*B/16 - 3*AA*AA/256
+
+	const eps = 1e-12
+	if math.Abs(r) < eps {
+		// y(y³ + p*y + q) = 0
+		roots = append(roots, 0)
+		roots = solveCubic(0, p, q, roots)
+	} else {
+		// Pick the largest root z of the resolvent cubic, which splits the
+		// quartic into two quadratics.
+		var buf [3]float64
+		zs := solveCubic(-p/2, -r, r*p/2-q*q/8, buf[:0])
+		z := zs[0]
+		for _, zz := range zs[1:] {
+			z = math.Max(z, zz)
+		}
+		u := z*z - r
+		v := 2*z - p
+		switch {
+		case math.Abs(u) < eps:
+			u = 0
+		case u > 0:
+			u = math.Sqrt(u)
+		default:
+			return roots
+		}
+		switch {
+		case math.Abs(v) < eps:
+			v = 0
+		case v > 0:
+			v = math.Sqrt(v)
+		default:
+			return roots
+		}
+		if q < 0 {
+			v = -v
+		}
+		roots = solveQuadratic(1, v, z-u, roots)
+		roots = solveQuadratic(1, -v, z+u, roots)
+	}
+	for i := n; i < len(roots); i++ {
+		x := roots[i] - A4
+		for k := 0; k < 4; k++ {
+			f := (((a*x+b)*x+c)*x+d)*x + e
+			df := ((4*a*x+3*b)*x+2*c)*x + d
+			if df == 0 {
+				break
+			}
+			x -= f / df
+		}
+		roots[i] = x
+	}
+	sort.Float64s(roots[n:])
+	return roots
+}
+
+// solveCubic3 appends the real roots of a*x³ + b*x² + c*x + d to roots.
+func solveCubic3(a, b, c, d float64, roots []float64) []float64 {
+	if a == 0 {
+		return solveQuadratic(b, c, d, roots)
+	}
+	return solveCubic(b/a, c/a, d/a, roots)
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"fmt"
+	"math"
+)
+
+// A frame is an orthonormal coordinate system in which a shape's axis is the
+// Z axis.
+type frame struct {
+	origin, u, v, w Vec3
+}
+
+// newFrame makes a frame with the given origin and Z axis (the zero vector
+// means +Y).
+func newFrame(origin, axis Vec3) frame {
+	if axis == (Vec3{}) {
+		axis = Vec3{0, 1, 0}
+	}
+	w := axis.Normalize()
+	u, v := w.Basis()
+	return frame{origin, u, v, w}
+}
+
+// toLocal transforms r into the frame. The frame is orthonormal, so distances
+// along the two rays match.
+func (f *frame) toLocal(r Ray) Ray {
+	o := r.V.Sub(f.origin)
+	return Ray{
+		Vec3{o.Dot(f.u), o.Dot(f.v), o.Dot(f.w)},
+		Vec3{r.D.Dot(f.u), r.D.Dot(f.v), r.D.Dot(f.w)},
+	}
+}
+
+func (f *frame) dirToWorld(d Vec3) Vec3 {
+	return f.u.Mul(d.X).Add(f.v.Mul(d.Y)).Add(f.w.Mul(d.Z))
+}
+
+func (f *frame) matrix() Matrix4 {
+	return Matrix4{
+		{f.u.X, f.v.X, f.w.X, f.origin.X},
+		{f.u.Y, f.v.Y, f.w.Y, f.origin.Y},
+		{f.u.Z, f.v.Z, f.w.Z, f.origin.Z},
+		{0, 0, 0, 1},
+	}
+}
+
+// A crossing is a point at which a line crosses a surface: the ray
+// parameter, the outward unit normal (in the local frame), and the UV
+// coordinates.
+type crossing struct {
+	t  float64
+	n  Vec3
+	uv UV
+}
+
+// A shape is a surface described in a local frame by where lines cross it.
+type shape interface {
+	// crossings appends the points at which the line through r (in the
+	// local frame) crosses the surface, in increasing order of t.
+	crossings(r Ray, cs []crossing) []crossing
+	// localBounds returns a box containing the shape in the local frame.
+	localBounds() AABB
+}
+
+// A surface implements Object for a shape placed in the world by a frame.
+// The primitives in this file embed one.
+type surface struct {
+	frame
+	shape  shape
+	mat    *Material
+	closed bool // whether the shape is a solid
+}
+
+func (s *surface) init(sh shape, pos, axis Vec3, closed bool, matName string, materials map[string]*Material) error {
+	m, err := findMaterial(materials, matName)
+	if err != nil {
+		return err
+	}
+	*s = surface{frame: newFrame(pos, axis), shape: sh, mat: m, closed: closed}
+	return nil
+}
+
+// hit fills in h for the crossing c of r.
+func (s *surface) hit(r Ray, c crossing, h *Hit) {
+	h.D = c.t
+	h.P = r.At(c.t)
+	h.setNormal(s.dirToWorld(c.n).Normalize(), r.D)
+	h.UV = c.uv
+	h.Mat = s.mat
+}
+
+// nearest returns the first crossing of r beyond minDistance.
+func (s *surface) nearest(r Ray) (crossing, bool) {
+	var buf [4]crossing
+	for _, c := range s.shape.crossings(s.toLocal(r), buf[:0]) {
+		if c.t > minDistance {
+			return c, true
+		}
+	}
+	return crossing{}, false
+}
+
+func (s *surface) Intersect(r Ray, h *Hit) bool {
+	c, ok := s.nearest(r)
+	if !ok || c.t >= h.D {
+		return false
+	}
+	s.hit(r, c, h)
+	return true
+}
+
+func (s *surface) Occluded(r Ray, maxD float64) bool {
+	c, ok := s.nearest(r)
+	return ok && c.t < maxD
+}
+
+// Intervals pairs up successive crossings of closed shapes. Open shapes
+// have no inside.
+func (s *surface) Intervals(r Ray, ivs []Interval) []Interval {
+	if !s.closed {
+		return ivs
+	}
+	var buf [4]crossing
+	cs := s.shape.crossings(s.toLocal(r), buf[:0])
+	for i := 0; i+1 < len(cs); i += 2 {
+		var iv Interval
+		s.hit(r, cs[i], &iv.In)
+		s.hit(r, cs[i+1], &iv.Out)
+		ivs = append(ivs, iv)
+	}
+	return ivs
+}
+
+func (s *surface) Bounds() AABB {
+	return s.shape.localBounds().transform(s.frame.matrix())
+}
+
+func (s *surface) Material() *Material { return s.mat }
+
+// sortCrossings sorts a few crossings by t.
+func sortCrossings(cs []crossing) {
+	for i := 1; i < len(cs); i++ {
+		for j := i; j > 0 && cs[j].t < cs[j-1].t; j-- {
+			cs[j], cs[j-1] = cs[j-1], cs[j]
+		}
+	}
+}
+
+// capCrossing appends the crossing of the line through r with the disk of
+// radius rad (and inner radius inner) in the plane z at height z whose
+// normal points along +Z if up is true and -Z otherwise.
+func capCrossing(r Ray, z, inner, rad float64, up bool, cs []crossing) []crossing {
+	if r.D.Z == 0 {
+		return cs
+	}
+	t := (z - r.V.Z) / r.D.Z
+	p := r.At(t)
+	rho2 := p.X*p.X + p.Y*p.Y
+	if rho2 > rad*rad || rho2 < inner*inner {
+		return cs
+	}
+	n := Vec3{0, 0, -1}
+	if up {
+		n.Z = 1
+	}
+	uv := UV{U: 0.5 + p.X/(2*rad), V: 0.5 + p.Y/(2*rad), Scale: 1 / (2 * rad)}
+	return append(cs, crossing{t, n, uv})
+}
+
+// A Cylinder is a circular cylinder whose base is centered at Pos, extending
+// Height along Axis. Capped cylinders are closed solids; uncapped ones are
+// open tubes.
+type Cylinder struct {
+	Pos       Vec3
+	Axis      Vec3 // the zero vector means +Y
+	Radius    float64
+	Height    float64
+	Capped    bool
+	MatName   string `json:"mat"`
+	Transform *Transform
+
+	surface `json:"-"`
+}
+
+func (c *Cylinder) Initialize(materials map[string]*Material) error {
+	return c.surface.init(c, c.Pos, c.Axis, c.Capped, c.MatName, materials)
+}
+
+func (c *Cylinder) validate() error {
+	if c.Radius <= 0 || c.Height <= 0 {
+		return fmt.Errorf("radius and height must be positive")
+	}
+	return nil
+}
+
+func (c *Cylinder) crossings(r Ray, cs []crossing) []crossing {
+	n := len(cs)
+	// The side: x² + y² = Radius².
+	var buf [2]float64
+	a := r.D.X*r.D.X + r.D.Y*r.D.Y
+	b := 2 * (r.V.X*r.D.X + r.V.Y*r.D.Y)
+	cc := r.V.X*r.V.X + r.V.Y*r.V.Y - c.Radius*c.Radius
+	if a != 0 {
+		for _, t := range solveQuadratic(a, b, cc, buf[:0]) {
+			p := r.At(t)
+			if p.Z < 0 || p.Z > c.Height {
+				continue
+			}
+			uv := UV{
+				U:     0.5 + math.Atan2(p.Y, p.X)/(2*math.Pi),
+				V:     p.Z / c.Height,
+				Scale: 1 / math.Min(2*math.Pi*c.Radius, c.Height),
+			}
+			cs = append(cs, crossing{t, Vec3{p.X / c.Radius, p.Y / c.Radius, 0}, uv})
+		}
+	}
+	if c.Capped {
+		cs = capCrossing(r, 0, 0, c.Radius, false, cs)
+		cs = capCrossing(r, c.Height, 0, c.Radius, true, cs)
+	}
+	sortCrossings(cs[n:])
+	return cs
+}
+
+func (c *Cylinder) localBounds() AABB {
+	return AABB{Vec3{-c.Radius, -c.Radius, 0}, Vec3{c.Radius, c.Radius, c.Height}}
+}
+
+// A Cone is a circular cone (or, if TopRadius is positive, a truncated cone)
+// whose base of radius Radius is centered at Pos. It extends Height along
+// Axis. Capped cones are closed solids.
+type Cone struct {
+	Pos       Vec3
+	Axis      Vec3 // the zero vector means +Y
+	Radius    float64
+	TopRadius float64
+	Height    float64
+	Capped    bool
+	MatName   string `json:"mat"`
+	Transform *Transform
+
+	surface `json:"-"`
+}
+
+func (c *Cone) Initialize(materials map[string]*Material) error {
+	return c.surface.init(c, c.Pos, c.Axis, c.Capped, c.MatName, materials)
+}
+
+func (c *Cone) validate() error {
+	if c.Radius <= 0 || c.Height <= 0 || c.TopRadius < 0 {
+		return fmt.Errorf("radius and height must be positive and top radius non-negative; got %g, %g, %g", c.Radius, c.Height, c.TopRadius)
+	}
+	return nil
+}
+
+func (c *Cone) crossings(r Ray, cs []crossing) []crossing {
+	n := len(cs)
+	// The side: x² + y² = ρ(z)², where the radius ρ(z) = Radius - k*z.
+	k := (c.Radius - c.TopRadius) / c.Height
+	rho0 := c.Radius - k*r.V.Z // ρ at the ray origin
+	a := r.D.X*r.D.X + r.D.Y*r.D.Y - k*k*r.D.Z*r.D.Z
+	b := 2 * (r.V.X*r.D.X + r.V.Y*r.D.Y + k*rho0*r.D.Z)
+	cc := r.V.X*r.V.X + r.V.Y*r.V.Y - rho0*rho0
+	var buf [2]float64
+	for _, t := range solveQuadratic(a, b, cc, buf[:0]) {
+		p := r.At(t)
+		if p.Z < 0 || p.Z > c.Height {
+			continue
+		}
+		// The gradient of x² + y² - ρ(z)².
+		rho := c.Radius - k*p.Z
+		normal := Vec3{p.X, p.Y, k * rho}.Normalize()
+		uv := UV{
+			U:     0.5 + math.Atan2(p.Y, p.X)/(2*math.Pi),
+			V:     p.Z / c.Height,
+			Scale: 1 / math.Min(2*math.Pi*c.Radius, c.Height),
+		}
+		cs = append(cs, crossing{t, normal, uv})
+	}
+	if c.Capped {
+		cs = capCrossing(r, 0, 0, c.Radius, false, cs)
+		if c.TopRadius > 0 {
+			cs = capCrossing(r, c.Height, 0, c.TopRadius, true, cs)
+		}
+	}
+	sortCrossings(cs[n:])
+	return cs
+}
+
+func (c *Cone) localBounds() AABB {
+	m := math.Max(c.Radius, c.TopRadius)
+	return AABB{Vec3{-m, -m, 0}, Vec3{m, m, c.Height}}
+}
+
+// A Disk is a flat disk centered at Pos, facing along Axis. If InnerRadius
+// is positive, it is an annulus (a disk with a hole).
+type Disk struct {
+	Pos         Vec3
+	Axis        Vec3 // the normal; the zero vector means +Y
+	Radius      float64
+	InnerRadius float64
+	MatName     string `json:"mat"`
+	Transform   *Transform
+
+	surface `json:"-"`
+}
+
+func (d *Disk) Initialize(materials map[string]*Material) error {
+	return d.surface.init(d, d.Pos, d.Axis, false, d.MatName, materials)
+}
+
+func (d *Disk) validate() error {
+	if d.Radius <= 0 || d.InnerRadius < 0 || d.InnerRadius >= d.Radius {
+		return fmt.Errorf("need 0 <= inner radius < radius")
+	}
+	return nil
+}
+
+func (d *Disk) crossings(r Ray, cs []crossing) []crossing {
+	return capCrossing(r, 0, d.InnerRadius, d.Radius, true, cs)
+}
+
+func (d *Disk) localBounds() AABB {
+	return AABB{Vec3{-d.Radius, -d.Radius, 0}, Vec3{d.Radius, d.Radius, 0}}
+}
@@ -1,5 +1,9 @@
 package main
 
+import (
+	"math"
+)
+
 // A Ray is defined by a starting point, V, and an offset vector, D.
 type Ray struct {
 	V Vec3
@@ -10,3 +14,63 @@ type Ray struct {
 func (r Ray) At(d float64) Vec3 {
 	return r.D.Mul(d).Add(r.V)
 }
+
+// A rayDifferential describes how a ray changes from one pixel to the next:
+// dOx and dDx are the changes in its origin and direction across the image,
+// and dOy and dDy are the changes down it. Following them along a path gives
+// the size of the area that a pixel sees at each hit, for filtering textures.
+// A nil *rayDifferential is unknown, and stays unknown.
+type rayDifferential struct {
+	dOx, dOy Vec3
+	dDx, dDy Vec3
+}
+
+// at returns the differential of r at its hit at parameter t on a surface
+// with normal n. The neighboring rays are intersected with the plane tangent
+// to the surface there, and the changes in the hit point replace the changes
+// in the origin.
+func (rd *rayDifferential) at(r Ray, t float64, n Vec3) *rayDifferential {
+	if rd == nil {
+		return nil
+	}
+	dn := r.D.Dot(n)
+	transfer := func(dO, dD Vec3) Vec3 {
+		dP := dO.Add(dD.Mul(t))
+		if dn != 0 {
+			dP = dP.Sub(r.D.Mul(dP.Dot(n) / dn))
+		}
+		return dP
+	}
+	return &rayDifferential{
+		dOx: transfer(rd.dOx, rd.dDx),
+		dOy: transfer(rd.dOy, rd.dDy),
+		dDx: rd.dDx,
+		dDy: rd.dDy,
+	}
+}
+
+// width is the approximate width of the area seen by one pixel around the
+// origin of the ray (0 if it is unknown).
+func (rd *rayDifferential) width() float64 {
+	if rd == nil {
+		return 0
+	}
+	return math.Max(rd.dOx.Mag(), rd.dOy.Mag())
+}
+
+// scatter returns the differential of the ray that leaves the origin of rd
+// in the direction dir(d), where d is the direction of the incoming ray. The
+// neighboring rays are scattered by dir as well. This treats the surface as
+// flat: how its normal changes from one ray to the next is ignored.
+func (rd *rayDifferential) scatter(d Vec3, dir func(Vec3) Vec3) *rayDifferential {
+	if rd == nil {
+		return nil
+	}
+	out := dir(d)
+	return &rayDifferential{
+		dOx: rd.dOx,
+		dOy: rd.dOy,
+		dDx: dir(d.Add(rd.dDx)).Sub(out),
+		dDy: dir(d.Add(rd.dDy)).Sub(out),
+	}
+}
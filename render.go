@@ -1,41 +1,77 @@
 package main
 
 import (
+	"math/rand"
 	"sync"
 )
 
 type Rendering struct {
 	*Scene
-	HPixels int
+	HPixels    int
+	Integrator Integrator
+
+	// Supersampling is the number of samples per pixel along each axis.
+	// They are arranged in a regular grid within the pixel.
+	Supersampling int
+	// Samples is the number of integrator samples taken within each cell of
+	// the supersampling grid. If it is more than one, the samples are
+	// jittered across the cell.
+	Samples int
+	// Filter reconstructs pixels from the samples.
+	Filter Filter
 }
 
 // TODO: Also return a progress chan
 func (r *Rendering) Render(parallelism int) *Image {
-	w := r.HPixels
-	h := int(float64(w) * r.Camera.Aspect)
-	img := NewImage(w, h)
 	scanner := NewLineScanner(r.Camera, r.HPixels)
+	r.cameraDiff = scanner.differential()
+	film := NewFilm(scanner.hPixels, scanner.vPixels, r.Filter)
+	samples := make(chan []filmSample)
+	splatted := make(chan struct{})
+	go func() {
+		film.splat(samples)
+		close(splatted)
+	}()
+	n := r.Supersampling
 	var wg sync.WaitGroup
 	wg.Add(parallelism)
 	lines := scanner.Scan()
 	for i := 0; i < parallelism; i++ {
+		rng := rand.New(rand.NewSource(int64(i)))
 		go func() {
-			result := make([]Color, scanner.hPixels)
-			for line := range lines {
-				for x := line.xMin; x < line.xMax; x++ {
-					result[x] = r.Trace(line.rays[x])
+			for y := range lines {
+				line := make([]filmSample, 0, scanner.hPixels*n*n*r.Samples)
+				for x := 0; x < scanner.hPixels; x++ {
+					for sy := 0; sy < n; sy++ {
+						for sx := 0; sx < n; sx++ {
+							for j := 0; j < r.Samples; j++ {
+								// A single sample is at the center of its cell
+								// of the grid.
+								jx, jy := 0.5, 0.5
+								if r.Samples > 1 {
+									jx, jy = rng.Float64(), rng.Float64()
+								}
+								fx := float64(x) + (float64(sx)+jx)/float64(n)
+								fy := float64(y) + (float64(sy)+jy)/float64(n)
+								c := r.Integrator.Li(scanner.RayAt(fx, fy), rng)
+								line = append(line, filmSample{fx, fy, c})
+							}
+						}
+					}
 				}
-				img.SetLine(line.y, result)
+				samples <- line
 			}
 			wg.Done()
 		}()
 	}
 	wg.Wait()
-	return img
+	close(samples)
+	<-splatted
+	return film.Image()
 }
 
-// A LineScanner yields each line of pixels in the rendered image along with the
-// vectors to represent their position on the image plane.
+// A LineScanner yields each line of pixels in the rendered image and computes
+// the rays through their positions on the image plane.
 type LineScanner struct {
 	hPixels, vPixels int
 	camera           *Camera
@@ -78,32 +114,34 @@ func NewLineScanner(camera *Camera, hPixels int) *LineScanner {
 	}
 }
 
-type scanLine struct {
-	y          int
-	xMin, xMax int
-	rays       []Ray
-}
-
-func (s *LineScanner) Scan() <-chan scanLine {
-	ch := make(chan scanLine)
+// Scan yields the y coordinate of each line of the image.
+func (s *LineScanner) Scan() <-chan int {
+	ch := make(chan int)
 	go func() {
 		for y := 0; y < s.vPixels; y++ {
-			line := scanLine{
-				y:    y,
-				xMin: 0,
-				xMax: s.hPixels,
-				rays: make([]Ray, s.hPixels),
-			}
-			for x := range line.rays {
-				// The ray goes through the *center* of the pixel.
-				xDist := s.camera.Width*(float64(x)/float64(s.hPixels)) + 0.5*s.pixelSize
-				yDist := s.height*(float64(y)/float64(s.vPixels)) + 0.5*s.pixelSize
-				v := s.origin.Add(s.across.Mul(xDist)).Add(s.down.Mul(yDist))
-				line.rays[x] = Ray{V: s.vantage, D: v.Sub(s.vantage)}
-			}
-			ch <- line
+			ch <- y
 		}
 		close(ch)
 	}()
 	return ch
 }
+
+// RayAt returns the ray from the vantage point through the image plane at
+// (x, y), measured in pixels from the top left corner of the image. Integer
+// coordinates fall on pixel corners; the center of pixel (0, 0) is at (0.5,
+// 0.5).
+func (s *LineScanner) RayAt(x, y float64) Ray {
+	xDist := s.camera.Width * (x / float64(s.hPixels))
+	yDist := s.height * (y / float64(s.vPixels))
+	v := s.origin.Add(s.across.Mul(xDist)).Add(s.down.Mul(yDist))
+	return Ray{V: s.vantage, D: v.Sub(s.vantage)}
+}
+
+// differential returns the differential of the rays from RayAt, which all
+// start at the vantage point.
+func (s *LineScanner) differential() rayDifferential {
+	return rayDifferential{
+		dDx: s.across.Mul(s.pixelSize),
+		dDy: s.down.Mul(s.height / float64(s.vPixels)),
+	}
+}
@@ -3,113 +3,183 @@ package main
 import (
 	"fmt"
 	"math"
+	"math/rand"
 )
 
 // An RPrism is a rectangular prism with sides parallel to the axis planes.
 // It is defined by a point and extends in the positive X, Y, and Z dimensions
-// as given by Dim.
+// as given by Dim. A Transform can orient it otherwise.
 type RPrism struct {
-	Pos     Vec3       // corner with smallest X, Y, Z
-	Dim     [3]float64 // X, Y, Z
-	Mat     *Material  `json:"-"`
-	MatName string     `json:"mat"`
+	Pos       Vec3       // corner with smallest X, Y, Z
+	Dim       [3]float64 // X, Y, Z
+	Mat       *Material  `json:"-"`
+	MatName   string     `json:"mat"`
+	Transform *Transform
 }
 
 func (p *RPrism) Initialize(materials map[string]*Material) error {
-	m, ok := materials[p.MatName]
-	if !ok {
-		return fmt.Errorf("cannot find material %s", p.MatName)
+	m, err := findMaterial(materials, p.MatName)
+	if err != nil {
+		return err
 	}
 	p.Mat = m
 	return nil
 }
 
-// a, b, and c are dimensions (i.e. each is one of X, Y, Z)
-// For example, for the unit cube, to find an intersection with the side on the YZ plane (x=0), you might call
-// with arguments:
-//   bcPlane = 0
-//   minB    = 0
-//   maxB    = 1
-//   minC    = 0
-//   maxC    = 1
-// v and d are r.V and r.D vectors in the order [a, b, c].
-func rprismIntersects(q *rprismIntersectQ) (float64, bool) {
-	t := (q.bcPlane - q.v[0]) / q.d[0]
-	if t < 0 {
-		return 0, false
+func (p *RPrism) validate() error {
+	if p.Dim[0] <= 0 || p.Dim[1] <= 0 || p.Dim[2] <= 0 {
+		return fmt.Errorf("dimensions must be positive; got %v", p.Dim)
+	}
+	return nil
+}
+
+// slab finds the range of the ray parameter [tNear, tFar] in which the line
+// through r is inside p, along with the outward normals of the faces where
+// it enters and leaves.
+//
+// It uses the slab method: the box is the intersection of three slabs (the
+// space between two parallel planes), and the ray is inside the box for the
+// overlap of the intervals in which it is inside each slab.
+func (p *RPrism) slab(r Ray) (tNear, tFar float64, nNear, nFar Vec3, ok bool) {
+	v := [3]float64{r.V.X, r.V.Y, r.V.Z}
+	d := [3]float64{r.D.X, r.D.Y, r.D.Z}
+	lo := [3]float64{p.Pos.X, p.Pos.Y, p.Pos.Z}
+	tNear, tFar = math.Inf(-1), math.Inf(1)
+	nearAxis, farAxis := -1, -1
+	for i := 0; i < 3; i++ {
+		hi := lo[i] + p.Dim[i]
+		if d[i] == 0 {
+			// Parallel to the slab: either always or never inside it.
+			if v[i] < lo[i] || v[i] > hi {
+				return 0, 0, Vec3{}, Vec3{}, false
+			}
+			continue
+		}
+		t0 := (lo[i] - v[i]) / d[i]
+		t1 := (hi - v[i]) / d[i]
+		if t0 > t1 {
+			t0, t1 = t1, t0
+		}
+		if t0 > tNear {
+			tNear, nearAxis = t0, i
+		}
+		if t1 < tFar {
+			tFar, farAxis = t1, i
+		}
+		if tNear > tFar {
+			return 0, 0, Vec3{}, Vec3{}, false
+		}
 	}
-	b := q.v[1] + t*q.d[1]
-	c := q.v[2] + t*q.d[2]
-	if b >= q.minB && b <= q.maxB && c >= q.minC && c <= q.maxC {
-		return t, true
+	if farAxis < 0 {
+		// A zero direction never reaches a face.
+		return 0, 0, Vec3{}, Vec3{}, false
 	}
-	return 0, false
+	// The ray enters through the face it moves toward first and leaves
+	// through the opposite side.
+	var n [3]float64
+	n[nearAxis] = -math.Copysign(1, d[nearAxis])
+	nNear = Vec3{n[0], n[1], n[2]}
+	n = [3]float64{}
+	n[farAxis] = math.Copysign(1, d[farAxis])
+	nFar = Vec3{n[0], n[1], n[2]}
+	return tNear, tFar, nNear, nFar, true
 }
 
-type rprismIntersectQ struct {
-	v, d                            [3]float64
-	bcPlane, minB, maxB, minC, maxC float64
-	normal                          Vec3
+// nearest returns the distance to the nearest intersection of r with p beyond
+// minDistance, along with the normal of the face it hits. If the ray starts
+// inside the box, the nearest intersection is where it leaves.
+func (p *RPrism) nearest(r Ray) (float64, Vec3, bool) {
+	tNear, tFar, nNear, nFar, ok := p.slab(r)
+	switch {
+	case !ok:
+	case tNear > minDistance:
+		return tNear, nNear, true
+	case tFar > minDistance:
+		return tFar, nFar, true
+	}
+	return 0, Vec3{}, false
 }
 
-// P(t) = r.V.X + t*r.D.X = x1
-// t = (x1 - r.V.X) / r.D.X
-func (p *RPrism) Intersect(r Ray) (float64, *Material, Vec3, Vec3, bool) {
-	queries := []*rprismIntersectQ{
-		{
-			[3]float64{r.V.X, r.V.Y, r.V.Z},
-			[3]float64{r.D.X, r.D.Y, r.D.Z},
-			p.Pos.X, p.Pos.Y, p.Pos.Y + p.Dim[1], p.Pos.Z, p.Pos.Z + p.Dim[2],
-			Vec3{-1, 0, 0},
-		},
-		{
-			[3]float64{r.V.X, r.V.Y, r.V.Z},
-			[3]float64{r.D.X, r.D.Y, r.D.Z},
-			p.Pos.X + p.Dim[0], p.Pos.Y, p.Pos.Y + p.Dim[1], p.Pos.Z, p.Pos.Z + p.Dim[2],
-			Vec3{1, 0, 0},
-		},
-		{
-			[3]float64{r.V.Y, r.V.Z, r.V.X},
-			[3]float64{r.D.Y, r.D.Z, r.D.X},
-			p.Pos.Y, p.Pos.Z, p.Pos.Z + p.Dim[2], p.Pos.X, p.Pos.X + p.Dim[0],
-			Vec3{0, -1, 0},
-		},
-		{
-			[3]float64{r.V.Y, r.V.Z, r.V.X},
-			[3]float64{r.D.Y, r.D.Z, r.D.X},
-			p.Pos.Y + p.Dim[1], p.Pos.Z, p.Pos.Z + p.Dim[2], p.Pos.X, p.Pos.X + p.Dim[0],
-			Vec3{0, 1, 0},
-		},
-		{
-			[3]float64{r.V.Z, r.V.X, r.V.Y},
-			[3]float64{r.D.Z, r.D.X, r.D.Y},
-			p.Pos.Z, p.Pos.X, p.Pos.X + p.Dim[0], p.Pos.Y, p.Pos.Y + p.Dim[1],
-			Vec3{0, 0, -1},
-		},
-		{
-			[3]float64{r.V.Z, r.V.X, r.V.Y},
-			[3]float64{r.D.Z, r.D.X, r.D.Y},
-			p.Pos.Z + p.Dim[2], p.Pos.X, p.Pos.X + p.Dim[0], p.Pos.Y, p.Pos.Y + p.Dim[1],
-			Vec3{0, 0, 1},
-		},
+func (p *RPrism) Intersect(r Ray, h *Hit) bool {
+	d, normal, ok := p.nearest(r)
+	if !ok || d >= h.D {
+		return false
 	}
-	nearest := math.MaxFloat64
-	found := false
-	var normal Vec3
-	for _, q := range queries {
-		d, ok := rprismIntersects(q)
-		if ok {
-			if d > minDistance && d < nearest {
-				found = true
-				nearest = d
-				normal = q.normal
-			}
-		}
+	p.hit(r, d, normal, h)
+	return true
+}
+
+// hit fills in h for the point at distance d along r on the face with the
+// given normal.
+func (p *RPrism) hit(r Ray, d float64, normal Vec3, h *Hit) {
+	pt := r.At(d)
+	h.D = d
+	h.P = pt
+	h.setNormal(normal, r.D)
+	h.UV = p.uv(pt, normal)
+	h.Mat = p.Mat
+}
+
+func (p *RPrism) Intervals(r Ray, ivs []Interval) []Interval {
+	tNear, tFar, nNear, nFar, ok := p.slab(r)
+	if !ok {
+		return ivs
 	}
+	var iv Interval
+	p.hit(r, tNear, nNear, &iv.In)
+	p.hit(r, tFar, nFar, &iv.Out)
+	return append(ivs, iv)
+}
 
-	if !found {
-		return 0, nil, Vec3{}, Vec3{}, false
+func (p *RPrism) Occluded(r Ray, maxD float64) bool {
+	d, _, ok := p.nearest(r)
+	return ok && d < maxD
+}
+
+// uv computes UV coordinates for the point pt on the face with the given
+// normal. Each face is mapped to the unit square.
+func (p *RPrism) uv(pt, normal Vec3) UV {
+	rel := pt.Sub(p.Pos)
+	var u, v, du, dv float64
+	switch {
+	case normal.X != 0:
+		u, v, du, dv = rel.Z, rel.Y, p.Dim[2], p.Dim[1]
+	case normal.Y != 0:
+		u, v, du, dv = rel.X, rel.Z, p.Dim[0], p.Dim[2]
+	default:
+		u, v, du, dv = rel.X, rel.Y, p.Dim[0], p.Dim[1]
+	}
+	return UV{U: u / du, V: v / dv, Scale: 1 / math.Min(du, dv)}
+}
+
+func (p *RPrism) Bounds() AABB {
+	return AABB{p.Pos, p.Pos.Add(Vec3{p.Dim[0], p.Dim[1], p.Dim[2]})}
+}
+
+func (p *RPrism) Material() *Material { return p.Mat }
+
+func (p *RPrism) Area() float64 {
+	x, y, z := p.Dim[0], p.Dim[1], p.Dim[2]
+	return 2 * (x*y + y*z + z*x)
+}
+
+// SampleSurface picks a face with probability proportional to its area and
+// then a point uniformly on that face.
+func (p *RPrism) SampleSurface(rng *rand.Rand) (Vec3, Vec3) {
+	x, y, z := p.Dim[0], p.Dim[1], p.Dim[2]
+	u, v := rng.Float64(), rng.Float64()
+	// Choose the face's axis, then which of the two parallel faces it is.
+	f := rng.Float64() * (x*y + y*z + z*x)
+	side := 0.0
+	if rng.Float64() < 0.5 {
+		side = 1
+	}
+	sign := 2*side - 1
+	switch {
+	case f < x*y:
+		return p.Pos.Add(Vec3{u * x, v * y, side * z}), Vec3{0, 0, sign}
+	case f < x*y+y*z:
+		return p.Pos.Add(Vec3{side * x, u * y, v * z}), Vec3{sign, 0, 0}
 	}
-	pt := r.At(nearest)
-	return nearest, p.Mat, pt, normal, found
+	return p.Pos.Add(Vec3{u * x, side * y, v * z}), Vec3{0, sign, 0}
 }
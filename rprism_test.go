@@ -0,0 +1,264 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"reflect"
+	"testing"
+	"testing/quick"
+)
+
+// rprismFaceQuery and rprismFaceIntersect are the original per-face RPrism
+// intersection, kept as a reference for the slab method.
+//
+// a, b, and c are dimensions (i.e. each is one of X, Y, Z). v and d are r.V
+// and r.D in the order [a, b, c], and bcPlane is the position of the face
+// along a.
+type rprismFaceQuery struct {
+	v, d                            [3]float64
+	bcPlane, minB, maxB, minC, maxC float64
+	normal                          Vec3
+}
+
+func rprismFaceIntersect(q *rprismFaceQuery) (float64, bool) {
+	t := (q.bcPlane - q.v[0]) / q.d[0]
+	if t < 0 {
+		return 0, false
+	}
+	b := q.v[1] + t*q.d[1]
+	c := q.v[2] + t*q.d[2]
+	if b >= q.minB && b <= q.maxB && c >= q.minC && c <= q.maxC {
+		return t, true
+	}
+	return 0, false
+}
+
+func rprismNearestRef(p *RPrism, r Ray) (float64, Vec3, bool) {
+	xyz := [3]float64{r.V.X, r.V.Y, r.V.Z}
+	yzx := [3]float64{r.V.Y, r.V.Z, r.V.X}
+	zxy := [3]float64{r.V.Z, r.V.X, r.V.Y}
+	dxyz := [3]float64{r.D.X, r.D.Y, r.D.Z}
+	dyzx := [3]float64{r.D.Y, r.D.Z, r.D.X}
+	dzxy := [3]float64{r.D.Z, r.D.X, r.D.Y}
+	x0, y0, z0 := p.Pos.X, p.Pos.Y, p.Pos.Z
+	x1, y1, z1 := x0+p.Dim[0], y0+p.Dim[1], z0+p.Dim[2]
+	queries := []*rprismFaceQuery{
+		{xyz, dxyz, x0, y0, y1, z0, z1, Vec3{-1, 0, 0}},
+		{xyz, dxyz, x1, y0, y1, z0, z1, Vec3{1, 0, 0}},
+		{yzx, dyzx, y0, z0, z1, x0, x1, Vec3{0, -1, 0}},
+		{yzx, dyzx, y1, z0, z1, x0, x1, Vec3{0, 1, 0}},
+		{zxy, dzxy, z0, x0, x1, y0, y1, Vec3{0, 0, -1}},
+		{zxy, dzxy, z1, x0, x1, y0, y1, Vec3{0, 0, 1}},
+	}
+	nearest := math.MaxFloat64
+	found := false
+	var normal Vec3
+	for _, q := range queries {
+		if d, ok := rprismFaceIntersect(q); ok && d > minDistance && d < nearest {
+			found = true
+			nearest = d
+			normal = q.normal
+		}
+	}
+	return nearest, normal, found
+}
+
+var testPrism = &RPrism{Pos: Vec3{-1, 0.5, 2}, Dim: [3]float64{2, 1.5, 3}}
+
+func randIn(rng *rand.Rand, lo, hi float64) float64 {
+	return lo + rng.Float64()*(hi-lo)
+}
+
+// randInside returns a random point inside p, away from its faces.
+func randInside(rng *rand.Rand, p *RPrism) Vec3 {
+	return Vec3{
+		p.Pos.X + p.Dim[0]*randIn(rng, 0.01, 0.99),
+		p.Pos.Y + p.Dim[1]*randIn(rng, 0.01, 0.99),
+		p.Pos.Z + p.Dim[2]*randIn(rng, 0.01, 0.99),
+	}
+}
+
+func randPoint(rng *rand.Rand) Vec3 {
+	return Vec3{randIn(rng, -10, 10), randIn(rng, -10, 10), randIn(rng, -10, 10)}
+}
+
+func randDir(rng *rand.Rand) Vec3 {
+	return uniformSphere(rng.Float64(), rng.Float64())
+}
+
+// randOutside returns a random point outside p, away from its faces.
+func randOutside(rng *rand.Rand, p *RPrism) Vec3 {
+	const margin = 0.01
+	for {
+		q := randPoint(rng)
+		if q.X < p.Pos.X-margin || q.X > p.Pos.X+p.Dim[0]+margin ||
+			q.Y < p.Pos.Y-margin || q.Y > p.Pos.Y+p.Dim[1]+margin ||
+			q.Z < p.Pos.Z-margin || q.Z > p.Pos.Z+p.Dim[2]+margin {
+			return q
+		}
+	}
+}
+
+func checkAgainstRef(t *testing.T, p *RPrism, r Ray) {
+	t.Helper()
+	d, n, ok := p.nearest(r)
+	wantD, wantN, wantOK := rprismNearestRef(p, r)
+	if ok != wantOK {
+		t.Fatalf("ray %v: got hit=%t; want %t", r, ok, wantOK)
+	}
+	if !ok {
+		return
+	}
+	if math.Abs(d-wantD) > 1e-9*math.Max(1, wantD) || n != wantN {
+		t.Fatalf("ray %v: got (%g, %v); want (%g, %v)", r, d, n, wantD, wantN)
+	}
+	if !p.Occluded(r, d+1e-6) || p.Occluded(r, d-1e-6) {
+		t.Fatalf("ray %v: Occluded disagrees with hit at %g", r, d)
+	}
+}
+
+func TestRPrismIntersectRef(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	p := testPrism
+	for _, tt := range []struct {
+		name string
+		ray  func() Ray
+	}{
+		{"hits", func() Ray {
+			// Aim from outside at a point inside.
+			v := randOutside(rng, p)
+			return Ray{v, randInside(rng, p).Sub(v).Mul(randIn(rng, 0.1, 3))}
+		}},
+		{"random", func() Ray {
+			return Ray{randPoint(rng), randDir(rng)}
+		}},
+		{"inside", func() Ray {
+			return Ray{randInside(rng, p), randDir(rng).Mul(randIn(rng, 0.1, 3))}
+		}},
+		{"parallel", func() Ray {
+			// Zero out one or two direction components.
+			d := randDir(rng)
+			switch rng.Intn(6) {
+			case 0:
+				d.X = 0
+			case 1:
+				d.Y = 0
+			case 2:
+				d.Z = 0
+			case 3:
+				d.X, d.Y = 0, 0
+			case 4:
+				d.Y, d.Z = 0, 0
+			case 5:
+				d.X, d.Z = 0, 0
+			}
+			v := randPoint(rng)
+			if rng.Intn(2) == 0 {
+				v = randInside(rng, p)
+			}
+			return Ray{v, d}
+		}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var hits int
+			for i := 0; i < 10000; i++ {
+				r := tt.ray()
+				checkAgainstRef(t, p, r)
+				if _, _, ok := p.nearest(r); ok {
+					hits++
+				}
+			}
+			if hits == 0 {
+				t.Errorf("no rays hit the prism")
+			}
+		})
+	}
+}
+
+func TestRPrismIntersectQuick(t *testing.T) {
+	p := testPrism
+	f := func(vx, vy, vz, dx, dy, dz float64) bool {
+		r := Ray{Vec3{vx, vy, vz}, Vec3{dx, dy, dz}}
+		d, n, ok := p.nearest(r)
+		wantD, wantN, wantOK := rprismNearestRef(p, r)
+		if ok != wantOK {
+			return false
+		}
+		return !ok || (math.Abs(d-wantD) <= 1e-9*math.Max(1, wantD) && n == wantN)
+	}
+	cfg := &quick.Config{
+		MaxCount: 10000,
+		Rand:     rand.New(rand.NewSource(2)),
+		Values: func(args []reflect.Value, rng *rand.Rand) {
+			for i := range args {
+				args[i] = reflect.ValueOf(randIn(rng, -5, 5))
+			}
+		},
+	}
+	if err := quick.Check(f, cfg); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRPrismHit(t *testing.T) {
+	p := &RPrism{Pos: Vec3{0, 0, 0}, Dim: [3]float64{1, 1, 1}}
+	for _, tt := range []struct {
+		r      Ray
+		ok     bool
+		d      float64
+		normal Vec3
+	}{
+		{Ray{Vec3{-1, 0.5, 0.5}, Vec3{1, 0, 0}}, true, 1, Vec3{-1, 0, 0}},
+		{Ray{Vec3{0.5, 3, 0.5}, Vec3{0, -2, 0}}, true, 1, Vec3{0, 1, 0}},
+		{Ray{Vec3{0.5, 0.5, 0.5}, Vec3{0, 0, 1}}, true, 0.5, Vec3{0, 0, 1}},
+		{Ray{Vec3{-1, 2, 0.5}, Vec3{1, 0, 0}}, false, 0, Vec3{}},
+		{Ray{Vec3{2, 0.5, 0.5}, Vec3{1, 0, 0}}, false, 0, Vec3{}},
+		{Ray{Vec3{0.5, 0.5, 0.5}, Vec3{}}, false, 0, Vec3{}},
+	} {
+		h := newHit()
+		ok := p.Intersect(tt.r, &h)
+		if ok != tt.ok {
+			t.Errorf("Intersect(%v): got hit=%t; want %t", tt.r, ok, tt.ok)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		if h.D != tt.d || h.Normal != tt.normal {
+			t.Errorf("Intersect(%v): got (%g, %v); want (%g, %v)", tt.r, h.D, h.Normal, tt.d, tt.normal)
+		}
+		if want := tt.r.D.Dot(tt.normal) < 0; h.FrontFace != want {
+			t.Errorf("Intersect(%v): got FrontFace=%t; want %t", tt.r, h.FrontFace, want)
+		}
+	}
+}
+
+var benchRays = func() []Ray {
+	rng := rand.New(rand.NewSource(3))
+	rays := make([]Ray, 1024)
+	for i := range rays {
+		v := randPoint(rng)
+		// About half of the rays hit.
+		target := randInside(rng, testPrism)
+		if i%2 == 1 {
+			target = randPoint(rng)
+		}
+		rays[i] = Ray{v, target.Sub(v)}
+	}
+	return rays
+}()
+
+func BenchmarkRPrismIntersect(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		h := newHit()
+		testPrism.Intersect(benchRays[i%len(benchRays)], &h)
+	}
+}
+
+func BenchmarkRPrismIntersectRef(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		rprismNearestRef(testPrism, benchRays[i%len(benchRays)])
+	}
+}
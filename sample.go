@@ -0,0 +1,33 @@
+package main
+
+import (
+	"math"
+)
+
+// cosineHemisphere maps uniform samples u1, u2 in [0, 1) to a direction in
+// the hemisphere around +Z with density cos(θ)/π.
+func cosineHemisphere(u1, u2 float64) Vec3 {
+	r := math.Sqrt(u1)
+	phi := 2 * math.Pi * u2
+	return Vec3{r * math.Cos(phi), r * math.Sin(phi), math.Sqrt(math.Max(0, 1-u1))}
+}
+
+// uniformSphere maps uniform samples u1, u2 in [0, 1) to a direction on the
+// unit sphere with density 1/4π.
+func uniformSphere(u1, u2 float64) Vec3 {
+	z := 1 - 2*u1
+	r := math.Sqrt(math.Max(0, 1-z*z))
+	phi := 2 * math.Pi * u2
+	return Vec3{r * math.Cos(phi), r * math.Sin(phi), z}
+}
+
+// powerHeuristic is Veach's power heuristic (β = 2) for weighting a sample
+// drawn with density pdfF against another strategy with density pdfG.
+func powerHeuristic(pdfF, pdfG float64) float64 {
+	f := pdfF * pdfF
+	g := pdfG * pdfG
+	if f+g == 0 {
+		return 0
+	}
+	return f / (f + g)
+}
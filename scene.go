@@ -2,84 +2,264 @@ package main
 
 import (
 	"math"
+	"math/rand"
 )
 
 type Scene struct {
+	// Other scene files whose contents are merged into this one (see
+	// LoadScene)
+	Include []string
+	// Variables for the expressions in this file's numeric fields (see
+	// expr.go)
+	Vars map[string]float64
+
 	Camera  *Camera
-	Ambient Color     // Ambient light
-	PLights []*PLight // Point lights
+	Ambient Color       // Ambient light
+	AO      *AOSettings // If set, ambient light is attenuated by ambient occlusion
+	PLights []*PLight   // Point lights
+
+	// If set, the environment is what rays that leave the scene see, and
+	// it lights the scene as well.
+	Environment *Environment
 
-	// Materials
+	// If set, a photon map is built to render caustics.
+	Photons *PhotonSettings
+
+	// Materials and the textures they use
 	Materials map[string]*Material
+	Textures  map[string]*TextureSpec
+
+	// The objects in the scene
+	Primitives
 
-	// Some kinds of objects have convenient representations for input.
-	RPrisms []*RPrism
-	Planes  []*PlaneObject
+	// Named groups of objects, which appear in the scene only where they
+	// are instanced (by Instances or by other groups).
+	Groups    map[string]*Group
+	Instances []*Instance
+
+	// The files the scene was loaded from, if any, for locating errors.
+	sources *sourceMap
 
 	// The computed list of objects over which the tracer iterates.
 	objects []Object
+	// The computed list of lights sampled by the path tracer.
+	lights []Light
+	// The area lights for emissive objects.
+	areaLights []*areaLight
+	emitters   map[int]*areaLight // by object index
+	// The light from Environment, if it is set.
+	env *envLight
+	// The caustic photon map, if Photons is set.
+	photons *photonMap
+	// The differential of camera rays from one pixel to the next. Set when
+	// rendering.
+	cameraDiff rayDifferential
+}
+
+// Primitives are the lists of objects that make up a scene or group. Some
+// kinds of objects have convenient representations for input.
+type Primitives struct {
+	RPrisms      []*RPrism
+	Spheres      []*Sphere
+	Cylinders    []*Cylinder
+	Cones        []*Cone
+	Disks        []*Disk
+	Tori         []*Torus
+	SDFs         []*SDF
+	Heightfields []*Heightfield
+	Quads        []*Quad
+	Planes       []*PlaneObject
+	CSG          []*CSG
+	Generators   []*Generator
 }
 
 // Don't consider it an intersection if the distance is less than this cutoff.
 const minDistance = 0.0001
 
+// maxDistance is farther than any intersection.
+const maxDistance = math.MaxFloat64
+
 // An Object is any object in the scene.
 type Object interface {
 	Initialize(map[string]*Material) error
-	// If the ray intersects the object, return the distance to the nearest
-	// intersection (from ray.V, the eye point), the Material at that point,
-	// the intersection point, the normal vector at that point, and true.
-	// Otherwise ok is false.
-	Intersect(Ray) (d float64, mat *Material, p, normal Vec3, ok bool)
+	// If the ray intersects the object at a distance (from ray.V, the eye
+	// point) less than h.D, Intersect fills in h for the nearest such
+	// intersection and returns true. Otherwise it leaves h alone and returns
+	// false.
+	Intersect(r Ray, h *Hit) bool
+	// Occluded reports whether the ray intersects the object at any
+	// distance less than maxD. This is cheaper than Intersect because it
+	// doesn't need the nearest intersection or any details about it.
+	Occluded(r Ray, maxD float64) bool
+	// Bounds returns a box containing the object.
+	Bounds() AABB
 }
 
 // After loading the scene from file, load all objects into the objects slice.
+// Initialize reports all of the problems it finds, not just the first.
 func (s *Scene) Initialize() error {
-	for _, rp := range s.RPrisms {
-		s.objects = append(s.objects, rp)
+	errs := &errorList{sources: s.sources}
+	s.validate(errs)
+	textures := make(map[string]Texture)
+	for _, name := range sortedKeys(s.Textures) {
+		t, err := s.Textures[name].Initialize()
+		if err != nil {
+			errs.report(jsonPath{"textures", name}, err)
+			continue
+		}
+		textures[name] = t
 	}
-	for _, p := range s.Planes {
-		s.objects = append(s.objects, p)
+	for _, name := range sortedKeys(s.Materials) {
+		if err := s.Materials[name].Initialize(textures); err != nil {
+			errs.report(jsonPath{"materials", name}, err)
+		}
 	}
-	for _, o := range s.objects {
-		if err := o.Initialize(s.Materials); err != nil {
-			return err
+	groups := newGroupBuilder(s.Materials, s.Groups, errs)
+	s.objects = append(s.objects, groups.primitives(nil, &s.Primitives, "")...)
+	for i, inst := range s.Instances {
+		if o := groups.instance(jsonPath{"instances", i}, inst, ""); o != nil {
+			s.objects = append(s.objects, o)
 		}
 	}
+	if s.Environment != nil {
+		env, err := s.Environment.Initialize()
+		if err != nil {
+			errs.report(jsonPath{"environment"}, err)
+		}
+		s.env = env
+	}
+	if err := errs.err(); err != nil {
+		return err
+	}
+	for _, l := range s.PLights {
+		s.lights = append(s.lights, l)
+	}
+	s.emitters = make(map[int]*areaLight)
+	for i, o := range s.objects {
+		if l := newAreaLight(o); l != nil {
+			s.areaLights = append(s.areaLights, l)
+			s.emitters[i] = l
+			s.lights = append(s.lights, l)
+		}
+	}
+	if s.env != nil {
+		s.lights = append(s.lights, s.env)
+		if s.env.sun != nil {
+			s.lights = append(s.lights, s.env.sun)
+		}
+	}
+	if s.Ambient != Black {
+		s.lights = append(s.lights, ambientLight{s.Ambient})
+	}
 	return nil
 }
 
-// Trace traces a single ray through the scene.
-func (s *Scene) Trace(r Ray) (c Color) {
-	nearest := math.MaxFloat64
-	found := false
-	var (
-		mat  *Material
-		p    Vec3
-		norm Vec3
-	)
+// initObject initializes o and wraps it with the transform t, if t is not
+// nil.
+func initObject(o Object, t *Transform, materials map[string]*Material) (Object, error) {
+	if err := o.Initialize(materials); err != nil {
+		return nil, err
+	}
+	if t == nil {
+		return o, nil
+	}
+	return newTransformed(o, t)
+}
+
+// intersect finds the nearest object hit by r, if any.
+func (s *Scene) intersect(r Ray) (h Hit, ok bool) {
+	h = newHit()
+	for i, o := range s.objects {
+		if o.Intersect(r, &h) {
+			ok = true
+			h.Object = i
+		}
+	}
+	return h, ok
+}
+
+// occluded reports whether any object blocks the segment of length d leaving p
+// in the (unit) direction dir. It stops at the first blocker.
+func (s *Scene) occluded(p, dir Vec3, d float64) bool {
+	r := Ray{p, dir}
 	for _, obj := range s.objects {
-		d, m, pt, n, ok := obj.Intersect(r)
-		if ok && d < nearest {
-			found = true
-			nearest = d
-			mat = m
-			p = pt
-			norm = n
+		if obj.Occluded(r, d-minDistance) {
+			return true
 		}
 	}
+	return false
+}
+
+// texPoint describes the hit point p with coordinates uv for texturing, where
+// rd is the differential of the ray at the hit.
+func texPoint(p Vec3, uv UV, rd *rayDifferential) TexPoint {
+	return TexPoint{P: p, UV: uv, Width: rd.width()}
+}
+
+// Bound the recursion of Trace through mirrors and transparent objects.
+const maxTraceDepth = 8
+
+// Trace traces a single ray through the scene. The rng is used for ambient
+// occlusion.
+func (s *Scene) Trace(r Ray, rng *rand.Rand) (c Color) {
+	return s.trace(r, &s.cameraDiff, rng, 0)
+}
+
+// trace traces r, whose differential is rd, at the given depth of recursion.
+func (s *Scene) trace(r Ray, rd *rayDifferential, rng *rand.Rand, depth int) Color {
 	color := Black
+	h, found := s.intersect(r)
 	if !found {
+		if s.env != nil {
+			return s.env.Le(r.D.Normalize())
+		}
 		return color
 	}
+	mat, p := h.Mat, h.P
+	// Emissive surfaces are visible directly.
+	color = color.Add(mat.emitted())
+	// Shade the side of the surface facing the viewer.
+	norm := faceForward(h.Shading, r.D)
+
+	rd = rd.at(r, h.D, h.Normal)
+	tp := texPoint(p, h.UV, rd)
+
+	// Perfect specular reflection and transmission
+	if depth < maxTraceDepth {
+		reflect := func(v Vec3) Vec3 { return v.Normalize().Reflect(norm) }
+		if mat.Kr > 0 {
+			refl := reflect(r.D)
+			color = color.Add(s.trace(Ray{p, refl}, rd.scatter(r.D, reflect), rng, depth+1).MulS(mat.Kr))
+		}
+		if mat.Kt > 0 {
+			transmit := func(v Vec3) Vec3 {
+				if t, ok := mat.refract(v, h.Normal); ok {
+					return t
+				}
+				return reflect(v) // total internal reflection
+			}
+			t := transmit(r.D)
+			color = color.Add(s.trace(Ray{p, t}, rd.scatter(r.D, transmit), rng, depth+1).MulS(mat.Kt))
+		}
+	}
+
+	matColor := mat.ColorAt(tp)
+	kd := mat.KdAt(tp)
+
+	// Caustics
+	if s.photons != nil {
+		e := s.photons.irradiance(p, norm, s.Photons.Radius)
+		color = color.Add(e.Mul(matColor).MulS(kd))
+	}
+
 	// ambient term
-	la := s.Ambient.Mul(mat.Color)     // La, the ambient light * ambient object color
+	la := s.Ambient.Mul(matColor) // La, the ambient light * ambient object color
+	if s.AO != nil && la != Black {
+		la = la.MulS(s.unoccluded(p, norm, s.AO, rng))
+	}
 	color = color.Add(la.MulS(mat.Ka)) // ambient term is ka * La
 
-	// For further calculations it's nice to normalize all vectors.
-	norm = norm.Normalize()
 	// For each light, compute diffuse and specular components
-lights:
 	for _, light := range s.PLights {
 		// Compute the shadow ray
 		shadow := light.Pos
@@ -90,22 +270,41 @@ lights:
 		}
 		d := shadow.Mag() // distance from the point to the light
 		shadow = shadow.Normalize()
-		for _, obj := range s.objects {
-			if d2, _, _, _, ok := obj.Intersect(Ray{p, shadow}); ok {
-				if d2 < d-minDistance {
-					// An object blocks the shadow raw (i.e., this point is in shadow),
-					// so skip the specular and diffuse terms for this light.
-					continue lights
-				}
-			}
+		if s.occluded(p, shadow, d) {
+			// An object blocks the shadow ray (i.e., this point is in shadow),
+			// so skip the specular and diffuse terms for this light.
+			continue
 		}
 		// Point lights fall off according to the inverse square law.
 		intensity := light.Color.MulS(1.0 / (d * d))
 		// For the diffuse term, Li is the diffuse object color * light source.
-		li := intensity.Mul(mat.Color)
+		li := intensity.Mul(matColor)
 		diffuse := shadow.Dot(norm)
 		li = li.MulS(diffuse)
-		color = color.Add(li.MulS(mat.Kd))
+		color = color.Add(li.MulS(kd))
+	}
+	// Emissive objects and the environment contribute diffuse light as
+	// well; take one sample from each.
+	diffuse := matColor.MulS(kd)
+	for _, light := range s.areaLights {
+		color = color.Add(s.sampleDiffuse(light, p, norm, diffuse, rng))
+	}
+	if s.env != nil {
+		color = color.Add(s.sampleDiffuse(s.env, p, norm, diffuse, rng))
+		if s.env.sun != nil {
+			color = color.Add(s.sampleDiffuse(s.env.sun, p, norm, diffuse, rng))
+		}
 	}
 	return color
 }
+
+// sampleDiffuse estimates the light reflected at p (on a surface with unit
+// normal n facing the viewer and diffuse color kd * Color) from a single
+// sample of light.
+func (s *Scene) sampleDiffuse(light Light, p, n Vec3, diffuse Color, rng *rand.Rand) Color {
+	wi, d, li, pdf := light.SampleLi(p, rng)
+	if pdf == 0 || wi.Dot(n) <= 0 || s.occluded(p, wi, d) {
+		return Black
+	}
+	return li.Mul(diffuse).MulS(wi.Dot(n) / pdf)
+}
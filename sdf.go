@@ -0,0 +1,393 @@
+package main
+
+import (
+	"fmt"
+	"math"
+)
+
+// An SDF is an object given by a signed distance function: a function that
+// returns, for any point, the distance to the surface (negative inside). It
+// is rendered by sphere tracing: stepping along the ray by the distance to
+// the surface, which can never overshoot it, until the distance is tiny.
+type SDF struct {
+	Shape *SDFNode
+
+	Epsilon  float64 // Distance that counts as a hit (0 means 1e-4)
+	MaxSteps int     // Steps before giving up on a ray (0 means 256)
+	// StepScale is the fraction of the distance to step (0 means 1).
+	// Operators like twist distort distances, so shapes that use them may
+	// need smaller steps to avoid passing through thin parts.
+	StepScale float64
+	// MaxDistance limits rays through unbounded shapes (like infinite
+	// repetitions). 0 means 100.
+	MaxDistance float64
+
+	MatName   string `json:"mat"`
+	Transform *Transform
+
+	dist   func(Vec3) float64
+	bounds AABB
+	mat    *Material
+}
+
+// An SDFNode is a shape or an operator on shapes.
+type SDFNode struct {
+	// Shapes: sphere, box, torus, capsule, or mandelbulb.
+	// Operators: union, intersection, subtraction (the first child minus the
+	// others), smoothUnion and smoothSubtraction (which blend over distance
+	// K), repeat, and twist.
+	Type string
+
+	Center      Vec3    // sphere, box, torus, mandelbulb
+	Radius      float64 // sphere, capsule, mandelbulb (overall size; 0 means 1)
+	Size        Vec3    // box dimensions
+	MajorRadius float64 // torus (around the Y axis)
+	MinorRadius float64 // torus
+	A, B        Vec3    // capsule endpoints
+	Power       float64 // mandelbulb (0 means 8)
+	Iterations  int     // mandelbulb (0 means 8)
+
+	Children []*SDFNode
+	K        float64 // Blend distance for smooth operators
+	// Period is the spacing of copies for repeat along each axis (0 means
+	// no repetition along that axis). The child should fit in one cell.
+	Period Vec3
+	Twist  Rad // Rotation about the Y axis per unit of height
+}
+
+func (s *SDF) Initialize(materials map[string]*Material) error {
+	m, err := findMaterial(materials, s.MatName)
+	if err != nil {
+		return err
+	}
+	s.mat = m
+	if s.Shape == nil {
+		return fmt.Errorf("sdf has no shape")
+	}
+	if s.dist, s.bounds, err = s.Shape.compile(); err != nil {
+		return err
+	}
+	if s.Epsilon == 0 {
+		s.Epsilon = 1e-4
+	}
+	if s.MaxSteps == 0 {
+		s.MaxSteps = 256
+	}
+	if s.StepScale == 0 {
+		s.StepScale = 1
+	}
+	if s.MaxDistance == 0 {
+		s.MaxDistance = 100
+	}
+	return nil
+}
+
+func (s *SDF) validate() error {
+	switch {
+	case s.Epsilon < 0:
+		return fmt.Errorf("epsilon must not be negative; got %g", s.Epsilon)
+	case s.MaxSteps < 0:
+		return fmt.Errorf("maximum steps must not be negative; got %d", s.MaxSteps)
+	case s.StepScale < 0 || s.StepScale > 1:
+		return fmt.Errorf("step scale must be between 0 and 1; got %g", s.StepScale)
+	case s.MaxDistance < 0:
+		return fmt.Errorf("maximum distance must not be negative; got %g", s.MaxDistance)
+	}
+	return nil
+}
+
+// compile returns the distance function for n and a box containing its
+// surface.
+func (n *SDFNode) compile() (func(Vec3) float64, AABB, error) {
+	switch n.Type {
+	case "sphere":
+		c, r := n.Center, n.Radius
+		return func(p Vec3) float64 {
+			return p.Sub(c).Mag() - r
+		}, cube(c, r), nil
+	case "box":
+		c, half := n.Center, n.Size.Mul(0.5)
+		return func(p Vec3) float64 {
+			q := p.Sub(c)
+			q = Vec3{math.Abs(q.X) - half.X, math.Abs(q.Y) - half.Y, math.Abs(q.Z) - half.Z}
+			outside := Vec3{math.Max(q.X, 0), math.Max(q.Y, 0), math.Max(q.Z, 0)}.Mag()
+			inside := math.Min(math.Max(q.X, math.Max(q.Y, q.Z)), 0)
+			return outside + inside
+		}, AABB{c.Sub(half), c.Add(half)}, nil
+	case "torus":
+		c, R, r := n.Center, n.MajorRadius, n.MinorRadius
+		return func(p Vec3) float64 {
+			q := p.Sub(c)
+			return math.Hypot(math.Hypot(q.X, q.Z)-R, q.Y) - r
+		}, AABB{c.Sub(Vec3{R + r, r, R + r}), c.Add(Vec3{R + r, r, R + r})}, nil
+	case "capsule":
+		a, b, r := n.A, n.B, n.Radius
+		ba := b.Sub(a)
+		bb := ba.Dot(ba)
+		return func(p Vec3) float64 {
+			pa := p.Sub(a)
+			h := 0.0
+			if bb > 0 {
+				h = clamp(pa.Dot(ba) / bb)
+			}
+			return pa.Sub(ba.Mul(h)).Mag() - r
+		}, cube(a, r).Union(cube(b, r)), nil
+	case "mandelbulb":
+		return n.mandelbulb()
+	}
+
+	var children []func(Vec3) float64
+	var bounds []AABB
+	for _, child := range n.Children {
+		f, b, err := child.compile()
+		if err != nil {
+			return nil, AABB{}, err
+		}
+		children = append(children, f)
+		bounds = append(bounds, b)
+	}
+	switch n.Type {
+	case "union", "intersection", "subtraction", "smoothUnion", "smoothSubtraction":
+		if len(children) == 0 {
+			return nil, AABB{}, fmt.Errorf("sdf %s needs children", n.Type)
+		}
+	case "repeat", "twist":
+		if len(children) != 1 {
+			return nil, AABB{}, fmt.Errorf("sdf %s needs exactly one child", n.Type)
+		}
+	default:
+		return nil, AABB{}, fmt.Errorf("unknown sdf type %q", n.Type)
+	}
+	k := n.K
+	switch n.Type {
+	case "union":
+		b := emptyAABB
+		for _, cb := range bounds {
+			b = b.Union(cb)
+		}
+		return func(p Vec3) float64 {
+			d := math.Inf(1)
+			for _, f := range children {
+				d = math.Min(d, f(p))
+			}
+			return d
+		}, b, nil
+	case "smoothUnion":
+		b := emptyAABB
+		for _, cb := range bounds {
+			b = b.Union(cb)
+		}
+		// Blending bulges out by less than k.
+		b = AABB{b.Min.Sub(Vec3{k, k, k}), b.Max.Add(Vec3{k, k, k})}
+		return func(p Vec3) float64 {
+			d := children[0](p)
+			for _, f := range children[1:] {
+				d = smoothMin(d, f(p), k)
+			}
+			return d
+		}, b, nil
+	case "intersection":
+		b := bounds[0]
+		for _, cb := range bounds[1:] {
+			b = AABB{
+				Min: Vec3{math.Max(b.Min.X, cb.Min.X), math.Max(b.Min.Y, cb.Min.Y), math.Max(b.Min.Z, cb.Min.Z)},
+				Max: Vec3{math.Min(b.Max.X, cb.Max.X), math.Min(b.Max.Y, cb.Max.Y), math.Min(b.Max.Z, cb.Max.Z)},
+			}
+		}
+		return func(p Vec3) float64 {
+			d := math.Inf(-1)
+			for _, f := range children {
+				d = math.Max(d, f(p))
+			}
+			return d
+		}, b, nil
+	case "subtraction":
+		return func(p Vec3) float64 {
+			d := children[0](p)
+			for _, f := range children[1:] {
+				d = math.Max(d, -f(p))
+			}
+			return d
+		}, bounds[0], nil
+	case "smoothSubtraction":
+		return func(p Vec3) float64 {
+			d := children[0](p)
+			for _, f := range children[1:] {
+				d = -smoothMin(-d, f(p), k)
+			}
+			return d
+		}, bounds[0], nil
+	case "repeat":
+		f, period := children[0], n.Period
+		// The copies go on forever along the axes with a period; along
+		// the others they stay within the child's bounds.
+		b := bounds[0]
+		if period.X != 0 {
+			b.Min.X, b.Max.X = math.Inf(-1), math.Inf(1)
+		}
+		if period.Y != 0 {
+			b.Min.Y, b.Max.Y = math.Inf(-1), math.Inf(1)
+		}
+		if period.Z != 0 {
+			b.Min.Z, b.Max.Z = math.Inf(-1), math.Inf(1)
+		}
+		return func(p Vec3) float64 {
+			return f(Vec3{repeat(p.X, period.X), repeat(p.Y, period.Y), repeat(p.Z, period.Z)})
+		}, b, nil
+	default: // twist
+		f, twist := children[0], float64(n.Twist)
+		b := bounds[0]
+		// The child can be turned any way about the Y axis.
+		r := 0.0
+		for _, x := range [2]float64{b.Min.X, b.Max.X} {
+			for _, z := range [2]float64{b.Min.Z, b.Max.Z} {
+				r = math.Max(r, math.Hypot(x, z))
+			}
+		}
+		b = AABB{Vec3{-r, b.Min.Y, -r}, Vec3{r, b.Max.Y, r}}
+		return func(p Vec3) float64 {
+			s, c := math.Sincos(-twist * p.Y)
+			return f(Vec3{c*p.X - s*p.Z, p.Y, s*p.X + c*p.Z})
+		}, b, nil
+	}
+}
+
+// mandelbulb is the distance estimator for the power-n Mandelbulb fractal.
+func (n *SDFNode) mandelbulb() (func(Vec3) float64, AABB, error) {
+	c, scale := n.Center, n.Radius
+	if scale == 0 {
+		scale = 1
+	}
+	power := n.Power
+	if power == 0 {
+		power = 8
+	}
+	iterations := n.Iterations
+	if iterations == 0 {
+		iterations = 8
+	}
+	f := func(p Vec3) float64 {
+		p = p.Sub(c).Div(scale)
+		z := p
+		dr, r := 1.0, 0.0
+		for i := 0; i < iterations; i++ {
+			r = z.Mag()
+			if r > 2 {
+				break
+			}
+			theta := math.Acos(z.Y/r) * power
+			phi := math.Atan2(z.Z, z.X) * power
+			zr := math.Pow(r, power)
+			dr = math.Pow(r, power-1)*power*dr + 1
+			st, ct := math.Sincos(theta)
+			sp, cp := math.Sincos(phi)
+			z = Vec3{st * cp, ct, st * sp}.Mul(zr).Add(p)
+		}
+		if r == 0 {
+			return 0
+		}
+		return 0.5 * math.Log(r) * r / dr * scale
+	}
+	return f, cube(c, 1.2*scale), nil
+}
+
+// cube returns the box of half-width r centered at c.
+func cube(c Vec3, r float64) AABB {
+	return AABB{c.Sub(Vec3{r, r, r}), c.Add(Vec3{r, r, r})}
+}
+
+// smoothMin is a polynomial smooth minimum of a and b, blending over k.
+func smoothMin(a, b, k float64) float64 {
+	if k <= 0 {
+		return math.Min(a, b)
+	}
+	h := math.Max(k-math.Abs(a-b), 0) / k
+	return math.Min(a, b) - h*h*k/4
+}
+
+// repeat maps x into the cell of width period centered at 0.
+func repeat(x, period float64) float64 {
+	if period == 0 {
+		return x
+	}
+	return x - period*math.Round(x/period)
+}
+
+// march sphere traces r between the ray parameters tMin and tMax, returning
+// the parameter of the first surface crossing. A ray that starts on the
+// surface (as rays leaving a hit point do) first steps off it, and a ray
+// that starts inside finds where it leaves.
+func (s *SDF) march(r Ray, tMin, tMax float64) (float64, bool) {
+	dLen := r.D.Mag()
+	if dLen == 0 {
+		return 0, false
+	}
+	u := r.D.Div(dLen)
+	// March in world distance along the unit direction u.
+	d, dMax := tMin*dLen, tMax*dLen
+	left := false // whether the ray has left the neighborhood of the surface
+	inside := false
+	for i := 0; i < s.MaxSteps && d <= dMax; i++ {
+		dist := s.dist(r.V.Add(u.Mul(d)))
+		if !left {
+			if math.Abs(dist) <= s.Epsilon {
+				d += s.Epsilon
+				continue
+			}
+			left = true
+			inside = dist < 0
+		}
+		if inside {
+			dist = -dist
+		}
+		if dist < s.Epsilon {
+			return d / dLen, true
+		}
+		d += dist * s.StepScale
+	}
+	return 0, false
+}
+
+// nearest finds the first hit of r beyond minDistance and before maxD.
+func (s *SDF) nearest(r Ray, maxD float64) (float64, bool) {
+	tMax := maxD
+	if !s.bounds.bounded() {
+		tMax = math.Min(tMax, s.MaxDistance/r.D.Mag())
+	}
+	t0, t1, ok := s.bounds.clip(r, minDistance, tMax)
+	if !ok {
+		return 0, false
+	}
+	return s.march(r, t0, t1)
+}
+
+func (s *SDF) Intersect(r Ray, h *Hit) bool {
+	t, ok := s.nearest(r, h.D)
+	if !ok {
+		return false
+	}
+	h.D = t
+	h.P = r.At(t)
+	h.setNormal(s.normal(h.P), r.D)
+	h.UV = UV{}
+	h.Mat = s.mat
+	return true
+}
+
+// normal estimates the gradient of the distance function at p by sampling it
+// at the vertices of a small tetrahedron.
+func (s *SDF) normal(p Vec3) Vec3 {
+	e := s.Epsilon
+	var n Vec3
+	for _, k := range [4]Vec3{{1, -1, -1}, {-1, -1, 1}, {-1, 1, -1}, {1, 1, 1}} {
+		n = n.Add(k.Mul(s.dist(p.Add(k.Mul(e)))))
+	}
+	return n.Normalize()
+}
+
+func (s *SDF) Occluded(r Ray, maxD float64) bool {
+	_, ok := s.nearest(r, maxD)
+	return ok
+}
+
+func (s *SDF) Bounds() AABB { return s.bounds }
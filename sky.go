@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+// A sky is the Preetham et al. analytic daylight model ("A Practical Analytic
+// Model for Daylight", 1999). Radiance is in kcd/m².
+type sky struct {
+	sun       Vec3 // unit direction toward the sun
+	thetaS    float64
+	turbidity float64
+	zenith    [3]float64    // Y, x, y at the zenith
+	perez     [3][5]float64 // Perez coefficients A-E for Y, x, y
+}
+
+func newSky(sun Vec3, turbidity float64) *sky {
+	t := turbidity
+	s := &sky{
+		sun:       sun,
+		thetaS:    math.Acos(math.Max(-1, math.Min(1, sun.Y))),
+		turbidity: t,
+		perez: [3][5]float64{
+			{0.1787*t - 1.4630, -0.3554*t + 0.4275, -0.0227*t + 5.3251, 0.1206*t - 2.5771, -0.0670*t + 0.3703},
+			{-0.0193*t - 0.2592, -0.0665*t + 0.0008, -0.0004*t + 0.2125, -0.0641*t - 0.8989, -0.0033*t + 0.0452},
+			{-0.0167*t - 0.2608, -0.0950*t + 0.0092, -0.0079*t + 0.2102, -0.0441*t - 1.6537, -0.0109*t + 0.0529},
+		},
+	}
+	th := s.thetaS
+	chi := (4.0/9 - t/120) * (math.Pi - 2*th)
+	s.zenith[0] = (4.0453*t-4.9710)*math.Tan(chi) - 0.2155*t + 2.4192
+	th2, th3 := th*th, th*th*th
+	s.zenith[1] = t*t*(0.00166*th3-0.00375*th2+0.00209*th) +
+		t*(-0.02903*th3+0.06377*th2-0.03202*th+0.00394) +
+		(0.11693*th3 - 0.21196*th2 + 0.06052*th + 0.25886)
+	s.zenith[2] = t*t*(0.00275*th3-0.00610*th2+0.00317*th) +
+		t*(-0.04214*th3+0.08970*th2-0.04153*th+0.00516) +
+		(0.15346*th3 - 0.26756*th2 + 0.06670*th + 0.26688)
+	return s
+}
+
+// perezF is the Perez sky luminance distribution function for a direction at
+// zenith angle theta and angle gamma from the sun.
+func perezF(c [5]float64, theta, gamma float64) float64 {
+	cosG := math.Cos(gamma)
+	return (1 + c[0]*math.Exp(c[1]/math.Cos(theta))) *
+		(1 + c[2]*math.Exp(c[3]*gamma) + c[4]*cosG*cosG)
+}
+
+// radiance returns the sky radiance in the unit direction d. Below the
+// horizon the sky is black; the ground should be part of the scene. The model
+// doesn't cover twilight, so once the sun has set the whole sky is black.
+func (s *sky) radiance(d Vec3) Color {
+	if d.Y <= 0 || s.thetaS > math.Pi/2 {
+		return Black
+	}
+	theta := math.Acos(math.Min(1, d.Y))
+	gamma := math.Acos(math.Max(-1, math.Min(1, d.Dot(s.sun))))
+	var v [3]float64
+	for i := range v {
+		v[i] = s.zenith[i] * perezF(s.perez[i], theta, gamma) / perezF(s.perez[i], 0, s.thetaS)
+	}
+	return xyYToRGB(v[1], v[2], v[0])
+}
+
+// xyYToRGB converts CIE xyY to linear sRGB.
+func xyYToRGB(x, y, Y float64) Color {
+	if y == 0 {
+		return Black
+	}
+	X := x / y * Y
+	Z := (1 - x - y) / y * Y
+	return Color{
+		R: math.Max(0, 3.2406*X-1.5372*Y-0.4986*Z),
+		G: math.Max(0, -0.9689*X+1.8758*Y+0.0415*Z),
+		B: math.Max(0, 0.0557*X-0.2040*Y+1.0570*Z),
+	}
+}
+
+// Extraterrestrial solar illuminance, in klx, to match the units of the sky.
+const sunIlluminance = 128
+
+// sunColor is the irradiance from the sun after it passes through the
+// atmosphere, accounting for Rayleigh and aerosol (Ångström) scattering
+// at representative red, green, and blue wavelengths.
+func (s *sky) sunColor() Color {
+	if s.thetaS >= math.Pi/2 {
+		return Black
+	}
+	deg := s.thetaS * 180 / math.Pi
+	// Relative optical air mass (Kasten's formula).
+	m := 1 / (math.Cos(s.thetaS) + 0.15*math.Pow(93.885-deg, -1.253))
+	beta := 0.04608*s.turbidity - 0.04586
+	tau := func(lambda float64) float64 { // lambda in μm
+		rayleigh := math.Exp(-0.008735 * math.Pow(lambda, -4.08) * m)
+		aerosol := math.Exp(-beta * math.Pow(lambda, -1.3) * m)
+		return rayleigh * aerosol
+	}
+	return Color{tau(0.65), tau(0.57), tau(0.475)}.MulS(sunIlluminance)
+}
+
+// sunDirection returns the unit vector toward the sun at the given elevation
+// and azimuth (measured clockwise from north). North is -Z and east is +X.
+func sunDirection(elevation, azimuth float64) Vec3 {
+	return Vec3{
+		X: math.Cos(elevation) * math.Sin(azimuth),
+		Y: math.Sin(elevation),
+		Z: -math.Cos(elevation) * math.Cos(azimuth),
+	}
+}
+
+// solarPosition approximates the sun's elevation and azimuth at a latitude
+// for a date (YYYY-MM-DD) and local solar time (HH:MM).
+func solarPosition(date, clock string, latitude float64) (elevation, azimuth float64, err error) {
+	d, err := time.Parse("2006-01-02", date)
+	if err != nil {
+		return 0, 0, fmt.Errorf("bad sky date: %s", err)
+	}
+	t, err := time.Parse("15:04", clock)
+	if err != nil {
+		return 0, 0, fmt.Errorf("bad sky time: %s", err)
+	}
+	hours := float64(t.Hour()) + float64(t.Minute())/60
+	decl := -23.44 * math.Pi / 180 * math.Cos(2*math.Pi/365*float64(d.YearDay()+10))
+	hourAngle := (hours - 12) * 15 * math.Pi / 180
+	sinE := math.Sin(latitude)*math.Sin(decl) + math.Cos(latitude)*math.Cos(decl)*math.Cos(hourAngle)
+	elevation = math.Asin(sinE)
+	cosA := (math.Sin(decl) - sinE*math.Sin(latitude)) / (math.Cos(elevation) * math.Cos(latitude))
+	azimuth = math.Acos(math.Max(-1, math.Min(1, cosA)))
+	if hourAngle > 0 {
+		// Afternoon: the sun is in the west.
+		azimuth = 2*math.Pi - azimuth
+	}
+	return elevation, azimuth, nil
+}
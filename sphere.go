@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+)
+
+// A Sphere is a ball with the given center and radius.
+type Sphere struct {
+	Center    Vec3
+	Radius    float64
+	Mat       *Material `json:"-"`
+	MatName   string    `json:"mat"`
+	Transform *Transform
+}
+
+func (s *Sphere) Initialize(materials map[string]*Material) error {
+	m, err := findMaterial(materials, s.MatName)
+	if err != nil {
+		return err
+	}
+	s.Mat = m
+	return nil
+}
+
+func (s *Sphere) validate() error {
+	if s.Radius <= 0 {
+		return fmt.Errorf("radius must be positive; got %g", s.Radius)
+	}
+	return nil
+}
+
+// roots finds the ray parameters t0 <= t1 at which the line through r meets
+// the sphere by solving |r.V + t*r.D - Center|² = Radius².
+func (s *Sphere) roots(r Ray) (t0, t1 float64, ok bool) {
+	oc := r.V.Sub(s.Center)
+	a := r.D.Dot(r.D)
+	b := oc.Dot(r.D) // half of the usual b
+	c := oc.Dot(oc) - s.Radius*s.Radius
+	disc := b*b - a*c
+	if a == 0 || disc < 0 {
+		return 0, 0, false
+	}
+	// Avoid cancellation by computing the larger-magnitude root first.
+	q := -(b + math.Copysign(math.Sqrt(disc), b))
+	if q == 0 {
+		return -b / a, -b / a, true
+	}
+	t0, t1 = q/a, c/q
+	if t0 > t1 {
+		t0, t1 = t1, t0
+	}
+	return t0, t1, true
+}
+
+func (s *Sphere) nearest(r Ray) (float64, bool) {
+	t0, t1, ok := s.roots(r)
+	switch {
+	case !ok:
+	case t0 > minDistance:
+		return t0, true
+	case t1 > minDistance:
+		return t1, true
+	}
+	return 0, false
+}
+
+func (s *Sphere) Intersect(r Ray, h *Hit) bool {
+	d, ok := s.nearest(r)
+	if !ok || d >= h.D {
+		return false
+	}
+	s.hit(r, d, h)
+	return true
+}
+
+// hit fills in h for the point at distance d along r. The UV coordinates are
+// longitude and latitude, with V increasing toward +Y.
+func (s *Sphere) hit(r Ray, d float64, h *Hit) {
+	h.D = d
+	h.P = r.At(d)
+	n := h.P.Sub(s.Center).Div(s.Radius)
+	h.setNormal(n, r.D)
+	h.UV = UV{
+		U:     0.5 + math.Atan2(n.X, -n.Z)/(2*math.Pi),
+		V:     0.5 + math.Asin(math.Max(-1, math.Min(1, n.Y)))/math.Pi,
+		Scale: 1 / (math.Pi * s.Radius),
+	}
+	h.Mat = s.Mat
+}
+
+func (s *Sphere) Occluded(r Ray, maxD float64) bool {
+	d, ok := s.nearest(r)
+	return ok && d < maxD
+}
+
+func (s *Sphere) Intervals(r Ray, ivs []Interval) []Interval {
+	t0, t1, ok := s.roots(r)
+	if !ok {
+		return ivs
+	}
+	var iv Interval
+	s.hit(r, t0, &iv.In)
+	s.hit(r, t1, &iv.Out)
+	return append(ivs, iv)
+}
+
+func (s *Sphere) Bounds() AABB {
+	r := Vec3{s.Radius, s.Radius, s.Radius}
+	return AABB{s.Center.Sub(r), s.Center.Add(r)}
+}
+
+func (s *Sphere) Material() *Material { return s.Mat }
+
+func (s *Sphere) Area() float64 { return 4 * math.Pi * s.Radius * s.Radius }
+
+func (s *Sphere) SampleSurface(rng *rand.Rand) (Vec3, Vec3) {
+	n := uniformSphere(rng.Float64(), rng.Float64())
+	return s.Center.Add(n.Mul(s.Radius)), n
+}
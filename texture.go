@@ -0,0 +1,211 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+)
+
+// A Texture is a color that varies over space or over a surface. It is
+// evaluated at hit points.
+type Texture interface {
+	At(tp TexPoint) Color
+}
+
+// A UV is a pair of surface (texture) coordinates.
+type UV struct {
+	U, V float64
+	// Scale is roughly how fast U and V change per unit of distance
+	// along the surface.
+	Scale float64
+}
+
+// A TexPoint is a point at which to evaluate a texture.
+type TexPoint struct {
+	P  Vec3 // Position in the world
+	UV UV
+	// Width is the approximate width, in world units, of the area seen by
+	// one pixel around P (0 if unknown). It is used to filter image
+	// textures.
+	Width float64
+}
+
+// A TextureSpec describes a texture in the scene file. The procedural
+// (solid) textures blend between Color1 and Color2 based on the position in
+// the world; image textures are mapped using surface UV coordinates.
+type TextureSpec struct {
+	// One of checker, stripes, gradient, noise, fbm, turbulence, marble,
+	// wood, or image.
+	Type string
+
+	Color1, Color2 Color
+	Scale          float64 // Size of features in world units (0 means 1)
+	Offset         Vec3    // Translation of the texture
+	// Axis is the direction of stripes, gradients, and marble veins and the
+	// axis of the rings in wood (the zero vector means the X axis).
+	Axis    Vec3
+	Octaves int   // Octaves of noise for fbm, turbulence, marble, and wood (0 means 6)
+	Seed    int64 // Seed for the noise
+
+	// For image textures: a PNG or JPEG file, and how UVs outside of [0, 1)
+	// are handled: repeat (the default), clamp, or mirror. The image spans
+	// Scale units of UV space.
+	File string
+	Wrap string
+}
+
+func (t *TextureSpec) Initialize() (Texture, error) {
+	if t.Type == "image" {
+		return newImageTexture(t)
+	}
+	tex := &procTexture{spec: *t}
+	if tex.spec.Scale == 0 {
+		tex.spec.Scale = 1
+	}
+	if tex.spec.Axis == (Vec3{}) {
+		tex.spec.Axis = Vec3{1, 0, 0}
+	}
+	tex.spec.Axis = tex.spec.Axis.Normalize()
+	if tex.spec.Octaves == 0 {
+		tex.spec.Octaves = 6
+	}
+	switch t.Type {
+	case "checker", "stripes", "gradient":
+	case "noise", "fbm", "turbulence", "marble", "wood":
+		tex.noise = newPerlin(t.Seed)
+	default:
+		return nil, fmt.Errorf("unknown texture type %q", t.Type)
+	}
+	return tex, nil
+}
+
+type procTexture struct {
+	spec  TextureSpec
+	noise *perlin
+}
+
+func (t *procTexture) At(tp TexPoint) Color {
+	s := &t.spec
+	// Work in texture space, where features have unit size.
+	q := tp.P.Sub(s.Offset).Div(s.Scale)
+	var f float64 // blend factor in [0, 1]
+	switch s.Type {
+	case "checker":
+		// Nudge q so that surfaces lying on a cell boundary (such as the
+		// plane y=0) don't flicker between cells due to rounding error.
+		q = q.Add(Vec3{checkerBias, checkerBias, checkerBias})
+		n := math.Floor(q.X) + math.Floor(q.Y) + math.Floor(q.Z)
+		f = math.Abs(math.Mod(n, 2))
+	case "stripes":
+		f = math.Abs(math.Mod(math.Floor(q.Dot(s.Axis)), 2))
+	case "gradient":
+		f = clamp(q.Dot(s.Axis))
+	case "noise":
+		f = 0.5 * (t.noise.at(q) + 1)
+	case "fbm":
+		f = clamp(0.5 * (t.noise.fbm(q, s.Octaves) + 1))
+	case "turbulence":
+		f = clamp(t.noise.turbulence(q, s.Octaves))
+	case "marble":
+		f = 0.5 * (1 + math.Sin(math.Pi*(q.Dot(s.Axis)+4*t.noise.turbulence(q, s.Octaves))))
+	case "wood":
+		// Distance from the axis, perturbed by noise, in rings.
+		r := q.Sub(s.Axis.Mul(q.Dot(s.Axis))).Mag()
+		r += 0.3 * t.noise.fbm(q, s.Octaves)
+		f = r - math.Floor(r)
+	}
+	return s.Color1.MulS(1 - f).Add(s.Color2.MulS(f))
+}
+
+const checkerBias = 1e-6
+
+// perlin is Ken Perlin's improved gradient noise.
+type perlin struct {
+	perm [512]int
+}
+
+func newPerlin(seed int64) *perlin {
+	n := &perlin{}
+	for i, v := range rand.New(rand.NewSource(seed)).Perm(256) {
+		n.perm[i] = v
+		n.perm[i+256] = v
+	}
+	return n
+}
+
+// at returns the noise at p, in roughly [-1, 1].
+func (n *perlin) at(p Vec3) float64 {
+	fx, fy, fz := math.Floor(p.X), math.Floor(p.Y), math.Floor(p.Z)
+	x, y, z := p.X-fx, p.Y-fy, p.Z-fz
+	X, Y, Z := int(fx)&255, int(fy)&255, int(fz)&255
+	u, v, w := fade(x), fade(y), fade(z)
+	pm := &n.perm
+	a := pm[X] + Y
+	aa, ab := pm[a]+Z, pm[a+1]+Z
+	b := pm[X+1] + Y
+	ba, bb := pm[b]+Z, pm[b+1]+Z
+	return lerp(w,
+		lerp(v,
+			lerp(u, grad(pm[aa], x, y, z), grad(pm[ba], x-1, y, z)),
+			lerp(u, grad(pm[ab], x, y-1, z), grad(pm[bb], x-1, y-1, z))),
+		lerp(v,
+			lerp(u, grad(pm[aa+1], x, y, z-1), grad(pm[ba+1], x-1, y, z-1)),
+			lerp(u, grad(pm[ab+1], x, y-1, z-1), grad(pm[bb+1], x-1, y-1, z-1))))
+}
+
+// fbm is fractional Brownian motion: a sum of octaves of noise, each with
+// twice the frequency and half the amplitude of the last.
+func (n *perlin) fbm(p Vec3, octaves int) float64 {
+	var sum float64
+	amp := 0.5
+	for i := 0; i < octaves; i++ {
+		sum += amp * n.at(p)
+		p = p.Mul(2)
+		amp /= 2
+	}
+	return sum * 2
+}
+
+// turbulence is like fbm but sums the absolute value of each octave.
+func (n *perlin) turbulence(p Vec3, octaves int) float64 {
+	var sum float64
+	amp := 0.5
+	for i := 0; i < octaves; i++ {
+		sum += amp * math.Abs(n.at(p))
+		p = p.Mul(2)
+		amp /= 2
+	}
+	return sum * 2
+}
+
+func fade(t float64) float64 {
+	return t * t * t * (t*(t*6-15) + 10)
+}
+
+func lerp(t, a, b float64) float64 {
+	return a + t*(b-a)
+}
+
+func grad(hash int, x, y, z float64) float64 {
+	h := hash & 15
+	u := y
+	if h < 8 {
+		u = x
+	}
+	var v float64
+	switch {
+	case h < 4:
+		v = y
+	case h == 12 || h == 14:
+		v = x
+	default:
+		v = z
+	}
+	if h&1 != 0 {
+		u = -u
+	}
+	if h&2 != 0 {
+		v = -v
+	}
+	return u + v
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"math"
+)
+
+// A Torus is a ring centered at Pos around Axis. MajorRadius is the distance
+// from the center to the middle of the tube and MinorRadius is the tube's
+// radius.
+type Torus struct {
+	Pos         Vec3
+	Axis        Vec3 // the zero vector means +Y
+	MajorRadius float64
+	MinorRadius float64
+	MatName     string `json:"mat"`
+	Transform   *Transform
+
+	surface `json:"-"`
+}
+
+func (t *Torus) Initialize(materials map[string]*Material) error {
+	return t.surface.init(t, t.Pos, t.Axis, true, t.MatName, materials)
+}
+
+func (t *Torus) validate() error {
+	if t.MajorRadius <= 0 || t.MinorRadius <= 0 {
+		return fmt.Errorf("radii must be positive")
+	}
+	return nil
+}
+
+// crossings solves (|p|² + R² - r²)² = 4R²(x² + y²) for p on the line, which
+// is a quartic in t.
+func (t *Torus) crossings(r Ray, cs []crossing) []crossing {
+	// The quartic is best conditioned with a unit direction and an origin
+	// near the torus, so solve along the line from the point closest to the
+	// center and convert back afterwards.
+	dLen := r.D.Mag()
+	if dLen == 0 {
+		return cs
+	}
+	d := r.D.Div(dLen)
+	shift := -r.V.Dot(d)
+	o := r.V.Add(d.Mul(shift))
+
+	R2 := t.MajorRadius * t.MajorRadius
+	r2 := t.MinorRadius * t.MinorRadius
+	od := o.Dot(d)
+	oo := o.Dot(o)
+	k := oo + R2 - r2
+	a := 1.0
+	b := 4 * od
+	c := 2*k + 4*od*od - 4*R2*(d.X*d.X+d.Y*d.Y)
+	dd := 4*k*od - 8*R2*(o.X*d.X+o.Y*d.Y)
+	e := k*k - 4*R2*(o.X*o.X+o.Y*o.Y)
+
+	var buf [4]float64
+	for _, s := range solveQuartic(a, b, c, dd, e, buf[:0]) {
+		p := o.Add(d.Mul(s))
+		// The normal points away from the nearest point on the tube's
+		// center circle.
+		rho := math.Hypot(p.X, p.Y)
+		var center Vec3
+		if rho > 0 {
+			center = Vec3{p.X / rho * t.MajorRadius, p.Y / rho * t.MajorRadius, 0}
+		}
+		n := p.Sub(center).Normalize()
+		uv := UV{
+			U:     0.5 + math.Atan2(p.Y, p.X)/(2*math.Pi),
+			V:     0.5 + math.Atan2(p.Z, rho-t.MajorRadius)/(2*math.Pi),
+			Scale: 1 / (2 * math.Pi * t.MinorRadius),
+		}
+		cs = append(cs, crossing{(s + shift) / dLen, n, uv})
+	}
+	return cs
+}
+
+func (t *Torus) localBounds() AABB {
+	m := t.MajorRadius + t.MinorRadius
+	return AABB{Vec3{-m, -m, -t.MinorRadius}, Vec3{m, m, t.MinorRadius}}
+}
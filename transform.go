@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+)
+
+// A Transform places an object in the world. The object is scaled, then
+// rotated about the X, Y, and Z axes in that order, then translated. If
+// Matrix is set, it is applied last; it must be affine (with a bottom row of
+// 0, 0, 0, 1).
+type Transform struct {
+	Translate Vec3
+	Rotate    [3]Rad // about X, Y, and Z
+	Scale     Vec3   // the zero vector means no scaling
+	Matrix    *Matrix4
+}
+
+// matrix computes the object-to-world matrix for t.
+func (t *Transform) matrix() Matrix4 {
+	m := Identity()
+	if t.Scale != (Vec3{}) {
+		m = Scaling(t.Scale)
+	}
+	m = RotationX(float64(t.Rotate[0])).Mul(m)
+	m = RotationY(float64(t.Rotate[1])).Mul(m)
+	m = RotationZ(float64(t.Rotate[2])).Mul(m)
+	m = Translation(t.Translate).Mul(m)
+	if t.Matrix != nil {
+		m = t.Matrix.Mul(m)
+	}
+	return m
+}
+
+// translated returns a transform that applies t (which may be nil) and then
+// moves by d.
+func (t *Transform) translated(d Vec3) *Transform {
+	if t == nil {
+		return &Transform{Translate: d}
+	}
+	c := *t
+	if c.Matrix == nil {
+		c.Translate = c.Translate.Add(d)
+		return &c
+	}
+	m := Translation(d).Mul(*c.Matrix)
+	c.Matrix = &m
+	return &c
+}
+
+// newTransformed wraps o so that it is placed in the world by t.
+func newTransformed(o Object, t *Transform) (Object, error) {
+	if t.Matrix != nil && t.Matrix[3] != [4]float64{0, 0, 0, 1} {
+		return nil, fmt.Errorf("bad transform: matrix is not affine; its bottom row is %v, not [0 0 0 1]", t.Matrix[3])
+	}
+	toWorld := t.matrix()
+	toObject, err := toWorld.Inverse()
+	if err != nil {
+		return nil, fmt.Errorf("bad transform: %s", err)
+	}
+	x := &transformed{
+		Object:   o,
+		toWorld:  toWorld,
+		toObject: toObject,
+		normal:   toObject.Transpose(),
+	}
+	a := toWorld.MulDir(Vec3{1, 0, 0})
+	b := toWorld.MulDir(Vec3{0, 1, 0})
+	c := toWorld.MulDir(Vec3{0, 0, 1})
+	x.scale = math.Cbrt(math.Abs(a.Cross(b).Dot(c)))
+	surf, ok := o.(Surface)
+	if !ok {
+		return x, nil
+	}
+	// Sampling a surface uniformly by area only survives transforms that
+	// scale areas uniformly (rotations, translations, and uniform scales).
+	// Other transformed objects don't act as area lights.
+	const eps = 1e-9
+	s2 := a.Dot(a)
+	if math.Abs(b.Dot(b)-s2) > eps*s2 || math.Abs(c.Dot(c)-s2) > eps*s2 ||
+		math.Abs(a.Dot(b)) > eps*s2 || math.Abs(b.Dot(c)) > eps*s2 || math.Abs(c.Dot(a)) > eps*s2 {
+		return x, nil
+	}
+	return &transformedSurface{transformed: x, surf: surf, areaScale: s2}, nil
+}
+
+// A transformed is an object placed in the world by a transform. Rays are
+// transformed into the object's space, and the resulting points and normals
+// are transformed back.
+type transformed struct {
+	Object
+	toWorld, toObject Matrix4
+	normal            Matrix4 // inverse transpose of toWorld, for normals
+	scale             float64 // approximate change in length
+}
+
+// objectRay transforms r into object space. Affine transformations preserve
+// the ray parameter, so distances along the two rays match.
+func (x *transformed) objectRay(r Ray) Ray {
+	return Ray{x.toObject.MulPoint(r.V), x.toObject.MulDir(r.D)}
+}
+
+func (x *transformed) Intersect(r Ray, h *Hit) bool {
+	if !x.Object.Intersect(x.objectRay(r), h) {
+		return false
+	}
+	x.worldHit(r, h)
+	return true
+}
+
+// worldHit transforms h, a hit along r in object space, into the world.
+func (x *transformed) worldHit(r Ray, h *Hit) {
+	h.P = r.At(h.D)
+	h.Normal = x.normal.MulDir(h.Normal).Normalize()
+	h.Shading = x.normal.MulDir(h.Shading).Normalize()
+	h.UV.Scale /= x.scale
+}
+
+// Intervals makes transformed solids solids too. (It finds nothing if the
+// object isn't a Solid.)
+func (x *transformed) Intervals(r Ray, ivs []Interval) []Interval {
+	s, ok := x.Object.(Solid)
+	if !ok {
+		return ivs
+	}
+	n := len(ivs)
+	ivs = s.Intervals(x.objectRay(r), ivs)
+	for i := n; i < len(ivs); i++ {
+		x.worldHit(r, &ivs[i].In)
+		x.worldHit(r, &ivs[i].Out)
+	}
+	return ivs
+}
+
+func (x *transformed) Occluded(r Ray, maxD float64) bool {
+	return x.Object.Occluded(x.objectRay(r), maxD)
+}
+
+func (x *transformed) Bounds() AABB {
+	return x.Object.Bounds().transform(x.toWorld)
+}
+
+// A transformedSurface is a transformed Surface whose transform scales all
+// areas by the same factor.
+type transformedSurface struct {
+	*transformed
+	surf      Surface
+	areaScale float64
+}
+
+func (x *transformedSurface) Material() *Material { return x.surf.Material() }
+
+func (x *transformedSurface) Area() float64 { return x.surf.Area() * x.areaScale }
+
+func (x *transformedSurface) SampleSurface(rng *rand.Rand) (Vec3, Vec3) {
+	p, n := x.surf.SampleSurface(rng)
+	return x.toWorld.MulPoint(p), x.normal.MulDir(n).Normalize()
+}
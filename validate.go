@@ -0,0 +1,328 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// A jsonPath locates a value in a JSON document. Its elements are object
+// keys (strings) and array indexes (ints).
+type jsonPath []interface{}
+
+func (p jsonPath) String() string {
+	var b strings.Builder
+	for i, e := range p {
+		switch e := e.(type) {
+		case int:
+			fmt.Fprintf(&b, "[%d]", e)
+		default:
+			if i > 0 {
+				b.WriteByte('.')
+			}
+			fmt.Fprint(&b, e)
+		}
+	}
+	return b.String()
+}
+
+func (p jsonPath) key(k string) jsonPath { return append(p[:len(p):len(p)], k) }
+
+func (p jsonPath) index(i int) jsonPath { return append(p[:len(p):len(p)], i) }
+
+// lineCol converts the offset of the byte just past some position in raw to
+// a line and column.
+func lineCol(raw []byte, offset int64) (line, col int) {
+	first := raw[:offset]
+	newlines := bytes.Count(first, []byte{'\n'})
+	last := bytes.LastIndex(first, []byte{'\n'})
+	return newlines + 1, len(first) - last - 1
+}
+
+// jsonOffset finds the offset in raw at which the value at path starts.
+// Object keys are matched case-insensitively, as encoding/json does.
+func jsonOffset(raw []byte, path jsonPath) (int64, bool) {
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	for _, e := range path {
+		tok, err := dec.Token()
+		if err != nil {
+			return 0, false
+		}
+		switch e := e.(type) {
+		case string:
+			if tok != json.Delim('{') {
+				return 0, false
+			}
+			for {
+				k, err := dec.Token()
+				if err != nil || k == json.Delim('}') {
+					return 0, false
+				}
+				if s, _ := k.(string); strings.EqualFold(s, e) {
+					break
+				}
+				if err := skipJSON(dec); err != nil {
+					return 0, false
+				}
+			}
+		case int:
+			if tok != json.Delim('[') {
+				return 0, false
+			}
+			for i := 0; i < e; i++ {
+				if !dec.More() {
+					return 0, false
+				}
+				if err := skipJSON(dec); err != nil {
+					return 0, false
+				}
+			}
+			if !dec.More() {
+				return 0, false
+			}
+		}
+	}
+	return nextToken(raw, dec.InputOffset()), true
+}
+
+// skipJSON reads and discards the next value from dec.
+func skipJSON(dec *json.Decoder) error {
+	depth := 0
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		switch tok {
+		case json.Delim('{'), json.Delim('['):
+			depth++
+		case json.Delim('}'), json.Delim(']'):
+			depth--
+		}
+		if depth == 0 {
+			return nil
+		}
+	}
+}
+
+// An errorList collects the problems found while initializing a scene,
+// locating each in the scene's JSON when it can.
+type errorList struct {
+	sources *sourceMap // where the scene came from, if known
+	errs    []string
+}
+
+// report records err for the value at path. Repeats (as from a group built
+// with several default materials) are dropped.
+func (l *errorList) report(path jsonPath, err error) {
+	msg := fmt.Sprintf("%s: %s", path, err)
+	if f, local := l.sources.locate(path); f != nil {
+		if off, ok := jsonOffset(f.raw, local); ok {
+			line, col := lineCol(f.raw, off+1)
+			msg = fmt.Sprintf("%s (line %d, column %d): %s", local, line, col, err)
+		}
+		if f != l.sources.main {
+			msg = f.name + ": " + msg
+		}
+	}
+	for _, e := range l.errs {
+		if e == msg {
+			return
+		}
+	}
+	l.errs = append(l.errs, msg)
+}
+
+// err returns an error listing every problem, or nil if there are none.
+func (l *errorList) err() error {
+	switch len(l.errs) {
+	case 0:
+		return nil
+	case 1:
+		return errors.New(l.errs[0])
+	}
+	return fmt.Errorf("%d problems:\n\t%s", len(l.errs), strings.Join(l.errs, "\n\t"))
+}
+
+// sortedKeys returns the keys of m, a map with string keys, in order. Maps
+// are visited in order so that problems are reported in the same order each
+// time.
+func sortedKeys(m interface{}) []string {
+	var keys []string
+	for _, k := range reflect.ValueOf(m).MapKeys() {
+		keys = append(keys, k.String())
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// A validator checks a scene's description.
+type validator struct {
+	*errorList
+}
+
+// An object with a validate method can check its own description.
+type validatable interface {
+	validate() error
+}
+
+func (v *validator) check(path jsonPath, o validatable) {
+	if err := o.validate(); err != nil {
+		v.report(path, err)
+	}
+}
+
+func (v *validator) camera(c *Camera) {
+	path := jsonPath{"camera"}
+	if c == nil {
+		v.report(path, errors.New("missing"))
+		return
+	}
+	if c.Loc.D == (Vec3{}) {
+		v.report(path.key("loc").key("d"), errors.New("direction is zero"))
+	}
+	if c.Width <= 0 {
+		v.report(path, fmt.Errorf("width must be positive; got %g", c.Width))
+	}
+	if c.Haov <= 0 || c.Haov >= math.Pi {
+		v.report(path, errors.New("horizontal angle of view must be between 0 and 180 degrees"))
+	}
+	if c.Aspect <= 0 {
+		v.report(path, fmt.Errorf("aspect ratio must be positive; got %g", c.Aspect))
+	}
+}
+
+func (v *validator) ao(a *AOSettings) {
+	if a == nil {
+		return
+	}
+	path := jsonPath{"ao"}
+	if a.Samples < 1 {
+		v.report(path.key("samples"), fmt.Errorf("samples must be at least 1; got %d", a.Samples))
+	}
+	if a.Distance <= 0 {
+		v.report(path.key("distance"), fmt.Errorf("distance must be positive; got %g", a.Distance))
+	}
+}
+
+func (v *validator) photons(p *PhotonSettings) {
+	if p == nil {
+		return
+	}
+	path := jsonPath{"photons"}
+	if p.Count < 1 {
+		v.report(path.key("count"), fmt.Errorf("count must be at least 1; got %d", p.Count))
+	}
+	if p.Radius <= 0 {
+		v.report(path.key("radius"), fmt.Errorf("radius must be positive; got %g", p.Radius))
+	}
+	if p.MaxDepth < 0 {
+		v.report(path.key("maxdepth"), fmt.Errorf("maximum depth must not be negative; got %d", p.MaxDepth))
+	}
+}
+
+func (v *validator) environment(e *Environment) {
+	if e == nil {
+		return
+	}
+	path := jsonPath{"environment"}
+	if e.Type == "sky" && e.Turbidity != 0 && (e.Turbidity < 2 || e.Turbidity > 10) {
+		v.report(path.key("turbidity"), fmt.Errorf("turbidity must be between 2 and 10; got %g", e.Turbidity))
+	}
+	if e.Intensity < 0 {
+		v.report(path.key("intensity"), fmt.Errorf("intensity must not be negative; got %g", e.Intensity))
+	}
+}
+
+func (v *validator) primitives(path jsonPath, p *Primitives) {
+	for i, x := range p.RPrisms {
+		v.check(path.key("rprisms").index(i), x)
+	}
+	for i, x := range p.Spheres {
+		v.check(path.key("spheres").index(i), x)
+	}
+	for i, x := range p.Cylinders {
+		v.check(path.key("cylinders").index(i), x)
+	}
+	for i, x := range p.Cones {
+		v.check(path.key("cones").index(i), x)
+	}
+	for i, x := range p.Disks {
+		v.check(path.key("disks").index(i), x)
+	}
+	for i, x := range p.Tori {
+		v.check(path.key("tori").index(i), x)
+	}
+	for i, x := range p.SDFs {
+		v.check(path.key("sdfs").index(i), x)
+	}
+	for i, x := range p.Heightfields {
+		v.check(path.key("heightfields").index(i), x)
+	}
+	for i, x := range p.Quads {
+		v.check(path.key("quads").index(i), x)
+	}
+	for i, x := range p.Planes {
+		v.check(path.key("planes").index(i), x)
+	}
+	for i, c := range p.CSG {
+		v.csg(path.key("csg").index(i), c)
+	}
+	for i, g := range p.Generators {
+		gp := path.key("generators").index(i)
+		v.check(gp, g)
+		switch {
+		case g.RPrism != nil:
+			v.check(gp.key("rprism"), g.RPrism)
+		case g.Sphere != nil:
+			v.check(gp.key("sphere"), g.Sphere)
+		}
+	}
+}
+
+func (v *validator) csg(path jsonPath, c *CSG) {
+	for i, s := range c.Children {
+		p := path.key("children").index(i)
+		switch {
+		case s.RPrism != nil:
+			v.check(p.key("rprism"), s.RPrism)
+		case s.Sphere != nil:
+			v.check(p.key("sphere"), s.Sphere)
+		case s.Cylinder != nil:
+			v.check(p.key("cylinder"), s.Cylinder)
+		case s.Cone != nil:
+			v.check(p.key("cone"), s.Cone)
+		case s.Torus != nil:
+			v.check(p.key("torus"), s.Torus)
+		case s.CSG != nil:
+			v.csg(p.key("csg"), s.CSG)
+		}
+	}
+}
+
+func (v *validator) group(path jsonPath, g *Group) {
+	v.primitives(path, &g.Primitives)
+	for i, sub := range g.Groups {
+		v.group(path.key("groups").index(i), sub)
+	}
+}
+
+// validate checks the scene for degenerate geometry and out-of-range
+// settings, which would otherwise render as black or NaN pixels, and reports
+// every problem it finds to errs.
+func (s *Scene) validate(errs *errorList) {
+	v := validator{errs}
+	v.camera(s.Camera)
+	v.ao(s.AO)
+	v.environment(s.Environment)
+	v.photons(s.Photons)
+	v.primitives(nil, &s.Primitives)
+	for _, name := range sortedKeys(s.Groups) {
+		v.group(jsonPath{"groups", name}, s.Groups[name])
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
 	"math"
 )
 
@@ -69,10 +70,50 @@ func (v Vec3) Dot(w Vec3) float64 {
 	return v.X*w.X + v.Y*w.Y + v.Z*w.Z
 }
 
+// Reflect returns the reflection of the direction v about the unit normal n.
+func (v Vec3) Reflect(n Vec3) Vec3 {
+	return v.Sub(n.Mul(2 * v.Dot(n)))
+}
+
+// Refract returns the direction of the unit direction v after refraction at a
+// surface with unit normal n (pointing against v). eta is the ratio of the
+// index of refraction on v's side to that on the other side. ok is false in
+// the case of total internal reflection.
+func (v Vec3) Refract(n Vec3, eta float64) (t Vec3, ok bool) {
+	cosI := -v.Dot(n)
+	sin2T := eta * eta * (1 - cosI*cosI)
+	if sin2T > 1 {
+		return Vec3{}, false
+	}
+	cosT := math.Sqrt(1 - sin2T)
+	return v.Mul(eta).Add(n.Mul(eta*cosI - cosT)), true
+}
+
+// Basis returns two unit vectors which, along with the unit vector v, form an
+// orthonormal basis.
+func (v Vec3) Basis() (Vec3, Vec3) {
+	a := Vec3{1, 0, 0}
+	if math.Abs(v.X) > 0.9 {
+		a = Vec3{0, 1, 0}
+	}
+	u := v.Cross(a).Normalize()
+	return u, v.Cross(u)
+}
+
+// FromLocal converts v from the local frame in which the unit vector n is the
+// Z axis into world coordinates.
+func (v Vec3) FromLocal(n Vec3) Vec3 {
+	s, t := n.Basis()
+	return s.Mul(v.X).Add(t.Mul(v.Y)).Add(n.Mul(v.Z))
+}
+
 func (v *Vec3) UnmarshalJSON(b []byte) error {
-	a := [3]float64{}
+	var a []float64
 	if err := json.Unmarshal(b, &a); err != nil {
-		return err
+		return fmt.Errorf("vector must be an array of 3 numbers")
+	}
+	if len(a) != 3 {
+		return fmt.Errorf("vector needs 3 elements; got %d", len(a))
 	}
 	v.X, v.Y, v.Z = a[0], a[1], a[2]
 	return nil